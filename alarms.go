@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// alarmsMetric is the name under which the alarms are enabled or disabled, like a meter.
+const alarmsMetric = "alarms"
+
+// The states of an alarm, as named by the API
+var alarmStates = []string{"ok", "alarm", "insufficient data"}
+
+type alarm struct {
+	ID             string `json:"alarm_id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	ProjectID      string `json:"project_id"`
+	Severity       string `json:"severity"`
+	State          string `json:"state"`
+	StateTimestamp string `json:"state_timestamp"`
+}
+
+// listAlarms pages through the alarms, at most limit at a time, ordered by id so that each page
+// continues after the last alarm of the previous one. The Ceilometer v2 API ignores the paging
+// parameters and returns all alarms at once, so listing also stops at a page of known alarms.
+func listAlarms(client *gophercloud.ServiceClient, limit int) ([]alarm, error) {
+	var alarms []alarm
+	seen := make(map[string]bool)
+	marker := ""
+	for {
+		query := url.Values{
+			"limit": {strconv.Itoa(limit)},
+			"sort":  {"alarm_id:asc"},
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		var page []alarm
+		// The JSON decoder fills in the value response points to
+		var response interface{} = &page
+		if _, err := client.Get(client.ServiceURL("v2", "alarms")+"?"+query.Encode(), &response, nil); err != nil {
+			return nil, err
+		}
+
+		added := 0
+		for _, alarm := range page {
+			if !seen[alarm.ID] {
+				seen[alarm.ID] = true
+				alarms = append(alarms, alarm)
+				added++
+			}
+		}
+		if len(page) < limit || added == 0 {
+			return alarms, nil
+		}
+		marker = page[len(page)-1].ID
+	}
+}
+
+// alarmCollector exports the state of the alarms of a cloud.
+type alarmCollector struct {
+	cloud       *openstackCloud
+	state       *prometheus.Desc
+	stateSince  *prometheus.Desc
+	metaMetrics map[string]*prometheus.Desc
+}
+
+// NewAlarmCollector creates a collector for the alarms of cloud. It is registered alongside the
+// ceilometerCollector of the cloud if alarms are enabled by its metric selection.
+func NewAlarmCollector(cloud *openstackCloud) *alarmCollector {
+	constLabels := cloud.constLabels()
+	labels := []string{"alarm_id", "name", "type", "project_id", "severity"}
+	return &alarmCollector{
+		cloud:      cloud,
+		state:      prometheus.NewDesc(makeFQName("alarm_state"), "State of the alarm, one of ok, alarm or insufficient data", append(labels, "state"), constLabels),
+		stateSince: prometheus.NewDesc(makeFQName("alarm_state_timestamp_seconds"), "Time the alarm last changed its state", labels, constLabels),
+		metaMetrics: map[string]*prometheus.Desc{
+			"scrapeSuccess":  prometheus.NewDesc(makeFQName("alarm_scrape_success"), "Indicates if the alarms were successfully scraped", nil, constLabels),
+			"scrapeDuration": prometheus.NewDesc(makeFQName("alarm_scrape_duration_ns"), "The time taken to scrape the alarms", nil, constLabels),
+		},
+	}
+}
+
+func (c *alarmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.stateSince
+	for _, desc := range c.metaMetrics {
+		ch <- desc
+	}
+}
+
+func (c *alarmCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+// CollectWithContext lists the alarms, stopping the request when ctx is done. Nothing is
+// exported if the cloud has no alarms API.
+func (c *alarmCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t := time.Now()
+
+	cloud := c.cloud
+	cloud.mu.RLock()
+	connected, client := cloud.connected, cloud.alarmClient
+	cloud.mu.RUnlock()
+	if !connected || client == nil {
+		return
+	}
+
+	alarms, err := listAlarms(withContext(ctx, client), cloud.config.MaxResults)
+	if err != nil {
+		log.Warnf("Failed to list alarms of cloud %s: %v", cloud.config.Name, err)
+	}
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeSuccess"], prometheus.GaugeValue, btof(err == nil))
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeDuration"], prometheus.GaugeValue, float64(time.Since(t).Nanoseconds()))
+
+	for _, alarm := range alarms {
+		labels := []string{alarm.ID, alarm.Name, alarm.Type, alarm.ProjectID, alarm.Severity}
+		for _, state := range alarmStates {
+			ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, btof(alarm.State == state), append(labels, state)...)
+		}
+		if timestamp, err := parseTimestamp(alarm.StateTimestamp); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.stateSince, prometheus.GaugeValue, float64(timestamp.UnixNano())/float64(time.Second), labels...)
+		} else {
+			log.Debugf("Invalid state timestamp %q of alarm %s: %v", alarm.StateTimestamp, alarm.ID, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rackspace/gophercloud"
+)
+
+func TestAlarmCollector(t *testing.T) {
+	// Alarms are served a page at a time, after the marker
+	pages := map[string]string{
+		"":   `[{"alarm_id": "a1", "name": "cpu high", "type": "threshold", "project_id": "p1", "severity": "critical", "state": "alarm", "state_timestamp": "2020-01-02T03:04:05.5"}]`,
+		"a1": `[{"alarm_id": "a2", "name": "idle", "type": "gnocchi_aggregation_by_resources_threshold", "project_id": "p2", "state": "insufficient data", "state_timestamp": "2020-01-02T03:04:05+00:00"}]`,
+		"a2": `[]`,
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		if r.URL.Path != "/v2/alarms" || query.Get("limit") != "1" || query.Get("sort") != "alarm_id:asc" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(pages[query.Get("marker")]))
+	}))
+	defer server.Close()
+
+	cloud := &openstackCloud{
+		config:      defaultConfig(),
+		connected:   true,
+		alarmClient: &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	cloud.config.MaxResults = 1
+	collector := NewAlarmCollector(cloud)
+	ch := make(chan prometheus.Metric, 20)
+	collector.Collect(ch)
+	close(ch)
+
+	states := make(map[string]float64)
+	timestamps := make(map[string]float64)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		labels := make(map[string]string)
+		for _, label := range out.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		switch m.Desc() {
+		case collector.state:
+			states[labels["alarm_id"]+"/"+labels["state"]] = out.GetGauge().GetValue()
+		case collector.stateSince:
+			timestamps[labels["alarm_id"]] = out.GetGauge().GetValue()
+		case collector.metaMetrics["scrapeSuccess"]:
+			if out.GetGauge().GetValue() != 1 {
+				t.Errorf("expected the scrape to succeed")
+			}
+		}
+	}
+
+	for state, expected := range map[string]float64{
+		"a1/alarm":             1,
+		"a1/ok":                0,
+		"a1/insufficient data": 0,
+		"a2/insufficient data": 1,
+		"a2/alarm":             0,
+	} {
+		if value, ok := states[state]; !ok || value != expected {
+			t.Errorf("expected %s to be %v, got %v", state, expected, value)
+		}
+	}
+	if timestamps["a1"] != 1577934245.5 || timestamps["a2"] != 1577934245 {
+		t.Errorf("unexpected state timestamps %v", timestamps)
+	}
+	if requests != 3 {
+		t.Errorf("expected the alarms to be listed in 3 pages, got %d requests", requests)
+	}
+}
+
+func TestListAlarmsWithoutPaging(t *testing.T) {
+	// The Ceilometer v2 API returns all alarms, whatever the limit and marker
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"alarm_id": "a1"}, {"alarm_id": "a2"}]`))
+	}))
+	defer server.Close()
+
+	client := &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"}
+	alarms, err := listAlarms(client, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms) != 2 || requests != 2 {
+		t.Errorf("expected 2 alarms in 2 requests, got %d in %d", len(alarms), requests)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Reactive re-authentications closer together than this are refused, as the fresh token
+	// is evidently not accepted either and gophercloud would otherwise retry indefinitely.
+	minReauthInterval = 10 * time.Second
+	// Lower bound on the proactive refresh interval, so that a failing Keystone or very
+	// short-lived tokens do not cause a tight loop.
+	minRefreshInterval = 30 * time.Second
+)
+
+var errRecentlyAuthenticated = errors.New("token rejected shortly after authenticating, not retrying")
+
+// keystoneSession owns the ProviderClient shared by all service clients, and keeps its token
+// valid by re-authenticating when a request is rejected and before the token expires. The
+// fields of the provider are not modified once it is shared: the token is added to requests by
+// the transport of its HTTP client, and endpoints are located through the session, which
+// guard the current token and catalog with mu.
+type keystoneSession struct {
+	provider          *gophercloud.ProviderClient
+	auth              AuthConfig
+	opts              gophercloud.AuthOptions
+	endpointOverrides map[string]string
+	// httpClient makes the requests to Keystone, which do not carry the token of the session
+	httpClient http.Client
+
+	// authMu is held while authenticating, so that concurrent re-authentications wait for
+	// the first one rather than each requesting a token
+	authMu sync.Mutex
+
+	mu             sync.Mutex
+	token          string
+	catalogLocator gophercloud.EndpointLocator
+	authenticated  time.Time
+	expiresAt      time.Time
+	reauthCount    int
+	reauthFailures int
+}
+
+type keystoneSessionStats struct {
+	expiresAt      time.Time
+	reauthCount    int
+	reauthFailures int
+}
+
+// NewKeystoneSession authenticates with the credentials in config. Services listed in its
+// endpoint overrides, keyed by service type, are located at the given URL rather than through
+// the catalog.
+func NewKeystoneSession(config *Config) (*keystoneSession, error) {
+	opts := config.authOptions()
+	provider, err := openstack.NewClient(opts.IdentityEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	endpointOverrides := make(map[string]string, len(config.Endpoints)+1)
+	for serviceType, url := range config.Endpoints {
+		endpointOverrides[serviceType] = url
+	}
+	if config.Auth.Endpoint != "" {
+		endpointOverrides[config.storageServiceType()] = config.Auth.Endpoint
+	}
+
+	session := &keystoneSession{
+		provider:          provider,
+		auth:              config.Auth,
+		opts:              opts,
+		endpointOverrides: endpointOverrides,
+		httpClient:        httpClient,
+	}
+	session.authMu.Lock()
+	err = session.authenticate()
+	session.authMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	provider.HTTPClient = httpClient
+	provider.HTTPClient.Transport = &sessionTransport{session: session, base: transport(httpClient)}
+	provider.EndpointLocator = session.locateEndpoint
+
+	// A configured token exchanged for a new one keeps its expiry, so renewing it before then
+	// would not help
+	if method := session.auth.method(); method != authTokenEndpoint && method != authToken {
+		go session.refreshLoop()
+	}
+
+	return session, nil
+}
+
+// authenticate acquires a new token on a separate client, so that requests in flight keep
+// using the old token until the new one is ready. Must be called with authMu held.
+func (s *keystoneSession) authenticate() error {
+	fresh, err := openstack.NewClient(s.opts.IdentityEndpoint)
+	if err != nil {
+		return err
+	}
+	fresh.HTTPClient = s.httpClient
+	fresh.UserAgent = s.provider.UserAgent
+
+	if s.auth.method() == authToken && s.currentToken() != "" {
+		s.mu.Lock()
+		expiresAt := s.expiresAt
+		s.mu.Unlock()
+		if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+			log.Errorf("The configured token expired at %v and cannot be exchanged any more, other credentials must be configured", expiresAt)
+			return errTokenExpired
+		}
+	}
+
+	var expiresAt time.Time
+	switch {
+	case s.auth.method() == authTokenEndpoint:
+		if s.currentToken() != "" {
+			return errTokenNotRenewable
+		}
+		// Without a catalog, only the overridden endpoints can be located
+		fresh.TokenID = s.auth.Token
+		fresh.EndpointLocator = func(gophercloud.EndpointOpts) (string, error) {
+			return "", gophercloud.ErrEndpointNotFound
+		}
+	case s.auth.needsV3Extensions():
+		expiresAt, err = authenticateV3(fresh, &s.auth)
+	default:
+		if s.auth.method() == authToken {
+			// Exchange the given token for a new one through the token method
+			fresh.TokenID = s.auth.Token
+		}
+		recorder := &expiryRecorder{base: transport(fresh.HTTPClient)}
+		fresh.HTTPClient.Transport = recorder
+		err = openstack.Authenticate(fresh, s.opts)
+		if err == nil {
+			expiresAt, err = recorder.expiresAt, recorder.err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = fresh.TokenID
+	s.catalogLocator = fresh.EndpointLocator
+	s.authenticated = time.Now()
+	s.expiresAt = expiresAt
+	log.Debugf("Authenticated against %v, token expires at %v", s.opts.IdentityEndpoint, expiresAt)
+	return nil
+}
+
+func (s *keystoneSession) currentToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// locateEndpoint is the EndpointLocator of the provider, using the catalog of the current token.
+func (s *keystoneSession) locateEndpoint(opts gophercloud.EndpointOpts) (string, error) {
+	if url, ok := s.endpointOverrides[opts.Type]; ok {
+		return gophercloud.NormalizeURL(url), nil
+	}
+	s.mu.Lock()
+	locator := s.catalogLocator
+	s.mu.Unlock()
+	return locator(opts)
+}
+
+// reauthenticate is called when a request made with token is rejected with a 401. If the
+// token has been renewed since the request was sent, the request can be retried with the new
+// one right away.
+func (s *keystoneSession) reauthenticate(token string) error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	s.mu.Lock()
+	renewed := s.token != token
+	authenticated := s.authenticated
+	s.mu.Unlock()
+	if renewed {
+		return nil
+	}
+	if time.Since(authenticated) < minReauthInterval {
+		return errRecentlyAuthenticated
+	}
+	log.Info("Token rejected, re-authenticating")
+	return s.refreshLocked()
+}
+
+// refresh acquires a new token.
+func (s *keystoneSession) refresh() error {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	return s.refreshLocked()
+}
+
+// refreshLocked must be called with authMu held.
+func (s *keystoneSession) refreshLocked() error {
+	err := s.authenticate()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.reauthFailures++
+		log.Warnf("Failed to re-authenticate against %v: %v", s.opts.IdentityEndpoint, err)
+		return err
+	}
+	s.reauthCount++
+	return nil
+}
+
+func (s *keystoneSession) refreshLoop() {
+	for {
+		s.mu.Lock()
+		wait := s.expiresAt.Sub(time.Now()) - *tokenRefreshMargin
+		s.mu.Unlock()
+		if wait < minRefreshInterval {
+			wait = minRefreshInterval
+		}
+		time.Sleep(wait)
+		s.refreshIfExpiring(*tokenRefreshMargin)
+	}
+}
+
+// refreshIfExpiring acquires a new token if the current one expires within margin. Tokens without
+// a known expiry are only renewed once they are rejected.
+func (s *keystoneSession) refreshIfExpiring(margin time.Duration) {
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	s.mu.Lock()
+	expiring := !s.expiresAt.IsZero() && s.expiresAt.Sub(time.Now()) <= margin
+	s.mu.Unlock()
+	if expiring {
+		log.Debug("Token about to expire, refreshing")
+		s.refreshLocked()
+	}
+}
+
+func (s *keystoneSession) stats() keystoneSessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return keystoneSessionStats{
+		expiresAt:      s.expiresAt,
+		reauthCount:    s.reauthCount,
+		reauthFailures: s.reauthFailures,
+	}
+}
+
+// sessionTransport adds the current token of the session to each request. A request rejected
+// with a 401 is retried once the session has re-authenticated, or right away if the token was
+// already renewed while it was in flight.
+type sessionTransport struct {
+	session *keystoneSession
+	base    http.RoundTripper
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := t.session.currentToken()
+	resp, err := t.base.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// Requests whose body cannot be read again are not retried
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	if err := t.session.reauthenticate(token); err != nil {
+		log.Debugf("Not retrying rejected request to %s: %v", req.URL, err)
+		return resp, nil
+	}
+	retry := withToken(req, t.session.currentToken())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
+
+// withToken returns a copy of req carrying token, as a RoundTripper must not modify requests.
+func withToken(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	return req
+}
+
+// expiryRecorder reads the expiry of the tokens created through it from the responses of
+// Keystone, as the vendored client does not return it.
+type expiryRecorder struct {
+	base      http.RoundTripper
+	expiresAt time.Time
+	err       error
+}
+
+func (r *expiryRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil || req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/tokens") || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+	var body interface{}
+	if r.err = json.Unmarshal(content, &body); r.err == nil {
+		r.expiresAt, r.err = tokenExpiry(body)
+	}
+	return resp, nil
+}
+
+// transport returns the RoundTripper used by client.
+func transport(client http.Client) http.RoundTripper {
+	if client.Transport != nil {
+		return client.Transport
+	}
+	return http.DefaultTransport
+}
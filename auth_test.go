@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+)
+
+// fakeKeystone issues numbered tokens, and serves /service, which accepts only tokens that are
+// still valid.
+type fakeKeystone struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	issued int
+	valid  map[string]bool
+	// expiresAt is returned with each token, or left out if zero
+	expiresAt time.Time
+}
+
+func newFakeKeystone() *fakeKeystone {
+	keystone := &fakeKeystone{valid: make(map[string]bool), expiresAt: time.Now().Add(time.Hour)}
+	keystone.Server = httptest.NewServer(http.HandlerFunc(keystone.serveHTTP))
+	return keystone
+}
+
+func (k *fakeKeystone) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch r.URL.Path {
+	case "/v3/auth/tokens":
+		k.issued++
+		token := fmt.Sprintf("token%d", k.issued)
+		k.valid[token] = true
+		body := map[string]interface{}{
+			"catalog": []map[string]interface{}{{
+				"type":      telemetryServiceType,
+				"endpoints": []map[string]string{{"interface": "public", "region": "R1", "url": k.URL + "/"}},
+			}},
+		}
+		if !k.expiresAt.IsZero() {
+			body["expires_at"] = k.expiresAt.UTC().Format("2006-01-02T15:04:05.000000Z")
+		}
+		w.Header().Set("X-Subject-Token", token)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": body})
+	case "/service":
+		if !k.valid[r.Header.Get("X-Auth-Token")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// revoke invalidates all tokens issued so far.
+func (k *fakeKeystone) revoke() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.valid = make(map[string]bool)
+}
+
+func (k *fakeKeystone) issuedTokens() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.issued
+}
+
+func newTestSession(t *testing.T, keystone *fakeKeystone) (*keystoneSession, *gophercloud.ServiceClient) {
+	t.Helper()
+	config := defaultConfig()
+	config.Auth = AuthConfig{AuthURL: keystone.URL + "/v3", Username: "u", Password: "p", ProjectName: "x", DomainName: "Default"}
+	session, err := NewKeystoneSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, &gophercloud.ServiceClient{ProviderClient: session.provider, Endpoint: keystone.URL + "/"}
+}
+
+func getConcurrently(client *gophercloud.ServiceClient, count int) []error {
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var response interface{}
+			_, errs[i] = client.Get(client.ServiceURL("service"), &response, nil)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestSessionReauthenticatesOnce(t *testing.T) {
+	keystone := newFakeKeystone()
+	defer keystone.Close()
+	session, client := newTestSession(t, keystone)
+
+	// All requests rejected at once retry with the single new token
+	keystone.revoke()
+	session.mu.Lock()
+	session.authenticated = time.Now().Add(-time.Minute)
+	session.mu.Unlock()
+	for _, err := range getConcurrently(client, 20) {
+		if err != nil {
+			t.Errorf("expected the request to be retried with a new token, got %v", err)
+		}
+	}
+	if issued := keystone.issuedTokens(); issued != 2 {
+		t.Errorf("expected a single re-authentication, got %d tokens", issued)
+	}
+	if stats := session.stats(); stats.reauthCount != 1 || stats.reauthFailures != 0 {
+		t.Errorf("unexpected session stats %+v", stats)
+	}
+
+	// A token rejected right after authenticating is not renewed again
+	keystone.revoke()
+	for _, err := range getConcurrently(client, 5) {
+		if err == nil {
+			t.Errorf("expected the request to fail")
+		}
+	}
+	if issued := keystone.issuedTokens(); issued != 2 {
+		t.Errorf("expected no further re-authentication, got %d tokens", issued)
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	keystone := newFakeKeystone()
+	defer keystone.Close()
+	session, client := newTestSession(t, keystone)
+
+	// The expiry is read from the response of Keystone to the vendored client
+	if expiresAt := session.stats().expiresAt; !expiresAt.Equal(keystone.expiresAt.Truncate(time.Microsecond)) {
+		t.Errorf("expected the token to expire at %v, got %v", keystone.expiresAt, expiresAt)
+	}
+	session.refreshIfExpiring(time.Minute)
+	if issued := keystone.issuedTokens(); issued != 1 {
+		t.Errorf("expected the token not to be refreshed long before it expires, got %d tokens", issued)
+	}
+
+	// Refreshing while requests are in flight
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			session.refreshIfExpiring(2 * time.Hour)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		for _, err := range getConcurrently(client, 5) {
+			if err != nil {
+				t.Errorf("unexpected error during refresh: %v", err)
+			}
+		}
+	}
+	<-done
+	if stats := session.stats(); stats.reauthCount != 10 {
+		t.Errorf("expected 10 refreshes, got %+v", stats)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expected := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, response := range []string{
+		`{"token": {"expires_at": "2030-01-02T03:04:05.000000Z"}}`,
+		`{"access": {"token": {"id": "t", "expires": "2030-01-02T03:04:05Z"}}}`,
+	} {
+		var body interface{}
+		json.Unmarshal([]byte(response), &body)
+		if expiresAt, err := tokenExpiry(body); err != nil || !expiresAt.Equal(expected) {
+			t.Errorf("expected %s to expire at %v, got %v, %v", response, expected, expiresAt, err)
+		}
+	}
+}
+
+func TestSessionWithExpiredToken(t *testing.T) {
+	keystone := newFakeKeystone()
+	defer keystone.Close()
+	config := defaultConfig()
+	config.Auth = AuthConfig{AuthURL: keystone.URL + "/v3", Token: "configured", ProjectID: "x"}
+	session, err := NewKeystoneSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exchanged token expires with the configured one, after which it cannot be exchanged
+	session.mu.Lock()
+	session.expiresAt = time.Now().Add(-time.Second)
+	session.mu.Unlock()
+	if err := session.refresh(); err != errTokenExpired {
+		t.Errorf("expected the expired token not to be exchanged, got %v", err)
+	}
+	if issued := keystone.issuedTokens(); issued != 1 {
+		t.Errorf("expected no further token, got %d tokens", issued)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack"
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// storageBackend reads the data of meters from the service storing them. Backends present
+// their data as Ceilometer samples and statistics, so that meters are exported the same way
+// whichever service they are read from.
+type storageBackend interface {
+	// samples returns the samples of a meter in its query window, and whether they were
+	// truncated by settings.MaxSamples
+	samples(client *gophercloud.ServiceClient, meterName string, settings MeterConfig) ([]meters.OldSample, bool, error)
+	// statistics returns aggregates of the samples of a meter in its query window, grouped by
+	// the given statistics API fields
+	statistics(client *gophercloud.ServiceClient, meterName string, settings MeterConfig, groupBy []string) ([]meters.Statistics, error)
+}
+
+func newStorageBackend(backend string) storageBackend {
+	if backend == backendGnocchi {
+		return gnocchiBackend{}
+	}
+	return ceilometerBackend{}
+}
+
+// newStorageClient creates the client for the service of the configured backend.
+func newStorageClient(provider *gophercloud.ProviderClient, config *Config) (*gophercloud.ServiceClient, error) {
+	if config.Backend != backendGnocchi {
+		return openstack.NewTelemetryV2(provider, config.endpointOpts())
+	}
+	endpointOpts := config.endpointOpts()
+	endpointOpts.ApplyDefaults(metricServiceType)
+	url, err := provider.EndpointLocator(endpointOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &gophercloud.ServiceClient{ProviderClient: provider, Endpoint: url}, nil
+}
+
+// newSplitServiceClient creates the client for a service that was split from Ceilometer, such
+// as Aodh for alarms. Without it in the catalog, Ceilometer itself is used, as it served the
+// same API in earlier releases, unless meters are read from Gnocchi. It is nil if neither is
+// available.
+func newSplitServiceClient(provider *gophercloud.ProviderClient, config *Config, serviceType string, storageClient *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	endpointOpts := config.endpointOpts()
+	endpointOpts.ApplyDefaults(serviceType)
+	if url, err := provider.EndpointLocator(endpointOpts); err == nil {
+		return &gophercloud.ServiceClient{ProviderClient: provider, Endpoint: url}
+	}
+	if config.Backend == backendCeilometer {
+		return storageClient
+	}
+	return nil
+}
+
+// withContext returns a copy of client whose requests are cancelled when ctx is done. The
+// vendored gophercloud does not take a context, so it is set on each request by the transport
+// of a copy of the provider.
+func withContext(ctx context.Context, client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	provider := *client.ProviderClient
+	provider.HTTPClient.Transport = &contextTransport{ctx: ctx, base: transport(provider.HTTPClient)}
+	copied := *client
+	copied.ProviderClient = &provider
+	return &copied
+}
+
+// contextTransport sends requests with its context.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// listTimeWindow lists the items of an API from start to end, both included, with list, which
+// returns the number of items it read. APIs such as those of events and resources return at most
+// limit items, which may be any of those in the window, and cannot page through the rest, so the
+// window is split in two while list reads a full page. It returns false if some items were left
+// out, as more than limit of them share a microsecond, the precision of the queries.
+func listTimeWindow(start, end time.Time, limit int, list func(start, end time.Time) (int, error)) (bool, error) {
+	count, err := list(start, end)
+	if err != nil || count < limit {
+		return true, err
+	}
+	if end.Sub(start) < time.Microsecond {
+		return false, nil
+	}
+	middle := start.Add(end.Sub(start) / 2).Truncate(time.Microsecond)
+	first, err := listTimeWindow(start, middle, limit, list)
+	if err != nil {
+		return false, err
+	}
+	second, err := listTimeWindow(middle.Add(time.Microsecond), end, limit, list)
+	return first && second, err
+}
+
+// ceilometerBackend reads meters from the Ceilometer v2 API.
+type ceilometerBackend struct{}
+
+func (ceilometerBackend) samples(client *gophercloud.ServiceClient, meterName string, settings MeterConfig) ([]meters.OldSample, bool, error) {
+	return fetchSamples(client, meterName, settings)
+}
+
+func (ceilometerBackend) statistics(client *gophercloud.ServiceClient, meterName string, settings MeterConfig, groupBy []string) ([]meters.Statistics, error) {
+	query := meters.MeterStatisticsOpts{
+		QueryField: "timestamp",
+		QueryOp:    "gt",
+		QueryValue: time.Now().UTC().Add(-settings.MaxMetricAge).Format(timestampFormat),
+		Query:      filterPredicates(settings.Filters),
+		GroupBy:    groupBy,
+	}
+	log.Debugf("Querying statistics for %v: %v", meterName, query)
+	return meters.MeterStatistics(client, meterName, query).Extract()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cloudConfig is the subset of a clouds.yaml entry understood by the exporter.
+type cloudConfig struct {
+	Auth struct {
+		AuthURL           string `yaml:"auth_url"`
+		Username          string `yaml:"username"`
+		UserID            string `yaml:"user_id"`
+		Password          string `yaml:"password"`
+		ProjectID         string `yaml:"project_id"`
+		ProjectName       string `yaml:"project_name"`
+		TenantID          string `yaml:"tenant_id"`
+		TenantName        string `yaml:"tenant_name"`
+		DomainID          string `yaml:"domain_id"`
+		DomainName        string `yaml:"domain_name"`
+		UserDomainID      string `yaml:"user_domain_id"`
+		UserDomainName    string `yaml:"user_domain_name"`
+		ProjectDomainID   string `yaml:"project_domain_id"`
+		ProjectDomainName string `yaml:"project_domain_name"`
+		Token             string `yaml:"token"`
+		TrustID           string `yaml:"trust_id"`
+		Endpoint          string `yaml:"endpoint"`
+
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialName   string `yaml:"application_credential_name"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	} `yaml:"auth"`
+	AuthType     string `yaml:"auth_type"`
+	RegionName   string `yaml:"region_name"`
+	Interface    string `yaml:"interface"`
+	EndpointType string `yaml:"endpoint_type"`
+	CACert       string `yaml:"cacert"`
+	Verify       *bool  `yaml:"verify"`
+}
+
+// cloudsFilePaths returns the locations searched for a file, in the same order as
+// os-client-config: an explicit path from the environment, the working directory, the user
+// configuration directory and finally /etc/openstack.
+func cloudsFilePaths(envVariable, basename string) []string {
+	var paths []string
+	if path := os.Getenv(envVariable); path != "" {
+		paths = append(paths, path)
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	for _, dir := range []string{".", filepath.Join(configHome, "openstack"), "/etc/openstack"} {
+		for _, ext := range []string{".yaml", ".yml"} {
+			paths = append(paths, filepath.Join(dir, basename+ext))
+		}
+	}
+	return paths
+}
+
+// readCloudsFile parses the first file found among paths. If none exist, nil is returned.
+func readCloudsFile(paths []string) (map[string]interface{}, string, error) {
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		var parsed map[string]interface{}
+		if err := yaml.Unmarshal(content, &parsed); err != nil {
+			return nil, "", fmt.Errorf("%s: %v", path, err)
+		}
+		return parsed, path, nil
+	}
+	return nil, "", nil
+}
+
+// loadCloud looks up the named cloud in clouds.yaml, merged with the secrets in secure.yaml.
+func loadCloud(name string) (*cloudConfig, error) {
+	clouds, cloudsPath, err := readCloudsFile(cloudsFilePaths("OS_CLIENT_CONFIG_FILE", "clouds"))
+	if err != nil {
+		return nil, err
+	}
+	if clouds == nil {
+		return nil, fmt.Errorf("cloud %q requested, but no clouds.yaml was found", name)
+	}
+	secure, _, err := readCloudsFile(cloudsFilePaths("OS_CLIENT_SECURE_FILE", "secure"))
+	if err != nil {
+		return nil, err
+	}
+	merged := mergeMaps(clouds, secure)
+
+	entries, _ := merged["clouds"].(map[string]interface{})
+	entry, ok := entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: cloud %q not found", cloudsPath, name)
+	}
+
+	// Round-trip the merged entry through YAML to get it into its typed form
+	content, err := yaml.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	cloud := &cloudConfig{}
+	if err := yaml.Unmarshal(content, cloud); err != nil {
+		return nil, fmt.Errorf("%s: cloud %q: %v", cloudsPath, name, err)
+	}
+	return cloud, nil
+}
+
+// mergeMaps recursively merges override into base, with values from override taking precedence.
+func mergeMaps(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseMap, baseIsMap := merged[key].(map[string]interface{})
+		overrideMap, overrideIsMap := value.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[key] = mergeMaps(baseMap, overrideMap)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// applyCloud overrides the configuration with the settings of a clouds.yaml entry.
+func (c *Config) applyCloud(cloud *cloudConfig) {
+	for _, setting := range c.cloudSettings(cloud) {
+		if setting.value != "" {
+			*setting.field = setting.value
+		}
+	}
+	if cloud.Verify != nil {
+		c.Insecure = !*cloud.Verify
+	}
+	c.appliedCloud = cloud
+}
+
+// removeCloud resets the settings that were taken from a clouds.yaml entry by applyCloud, and
+// left as they were, to their defaults.
+func (c *Config) removeCloud(cloud *cloudConfig) {
+	defaults := defaultConfig()
+	defaultSettings := defaults.cloudSettings(cloud)
+	for i, setting := range c.cloudSettings(cloud) {
+		if setting.value != "" && *setting.field == setting.value {
+			*setting.field = *defaultSettings[i].field
+		}
+	}
+	if cloud.Verify != nil && c.Insecure == !*cloud.Verify {
+		c.Insecure = defaults.Insecure
+	}
+	c.appliedCloud = nil
+}
+
+type cloudSetting struct {
+	field *string
+	value string
+}
+
+// cloudSettings pairs the settings of the configuration with those of a clouds.yaml entry.
+func (c *Config) cloudSettings(cloud *cloudConfig) []cloudSetting {
+	return []cloudSetting{
+		{&c.Auth.AuthURL, cloud.Auth.AuthURL},
+		{&c.Auth.Username, cloud.Auth.Username},
+		{&c.Auth.UserID, cloud.Auth.UserID},
+		{&c.Auth.Password, cloud.Auth.Password},
+		{&c.Auth.ProjectID, cloud.Auth.TenantID},
+		{&c.Auth.ProjectID, cloud.Auth.ProjectID},
+		{&c.Auth.ProjectName, cloud.Auth.TenantName},
+		{&c.Auth.ProjectName, cloud.Auth.ProjectName},
+		{&c.Auth.DomainID, cloud.Auth.DomainID},
+		{&c.Auth.DomainName, cloud.Auth.DomainName},
+		{&c.Auth.UserDomainID, cloud.Auth.UserDomainID},
+		{&c.Auth.UserDomainName, cloud.Auth.UserDomainName},
+		{&c.Auth.ProjectDomainID, cloud.Auth.ProjectDomainID},
+		{&c.Auth.ProjectDomainName, cloud.Auth.ProjectDomainName},
+		{&c.Auth.Token, cloud.Auth.Token},
+		{&c.Auth.TrustID, cloud.Auth.TrustID},
+		{&c.Auth.Endpoint, cloud.Auth.Endpoint},
+		{&c.Auth.ApplicationCredentialID, cloud.Auth.ApplicationCredentialID},
+		{&c.Auth.ApplicationCredentialName, cloud.Auth.ApplicationCredentialName},
+		{&c.Auth.ApplicationCredentialSecret, cloud.Auth.ApplicationCredentialSecret},
+		{&c.Auth.Type, cloud.AuthType},
+		{&c.Region, cloud.RegionName},
+		{&c.Interface, normalizeInterface(cloud.EndpointType)},
+		{&c.Interface, normalizeInterface(cloud.Interface)},
+		{&c.CACert, cloud.CACert},
+	}
+}
+
+// normalizeAuthType maps the keystoneauth plugin names used in clouds.yaml and OS_AUTH_TYPE to
+// the methods known to the exporter.
+func normalizeAuthType(authType string) string {
+	switch authType {
+	case "v2password", "v3password":
+		return authPassword
+	case "v2token", "v3token":
+		return authToken
+	case "admin_token":
+		return authTokenEndpoint
+	}
+	return authType
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeCloudsFiles writes clouds.yaml and secure.yaml to a temporary directory, and points the
+// exporter to them. The user configuration directory is moved there too, so that no files of
+// the host are read.
+func writeCloudsFiles(t *testing.T, clouds, secure string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "clouds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	variables := map[string]string{"XDG_CONFIG_HOME": dir, "OS_CLIENT_CONFIG_FILE": "", "OS_CLIENT_SECURE_FILE": ""}
+	for variable, content := range map[string]string{"OS_CLIENT_CONFIG_FILE": clouds, "OS_CLIENT_SECURE_FILE": secure} {
+		if content == "" {
+			continue
+		}
+		path := filepath.Join(dir, strings.ToLower(variable)+".yaml")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		variables[variable] = path
+	}
+	setEnv(t, variables)
+	return dir
+}
+
+func TestCloudsFilePaths(t *testing.T) {
+	setEnv(t, map[string]string{"OS_CLIENT_CONFIG_FILE": "/custom/clouds.yaml", "XDG_CONFIG_HOME": "/xdg"})
+	expected := []string{
+		"/custom/clouds.yaml",
+		"clouds.yaml", "clouds.yml",
+		"/xdg/openstack/clouds.yaml", "/xdg/openstack/clouds.yml",
+		"/etc/openstack/clouds.yaml", "/etc/openstack/clouds.yml",
+	}
+	if paths := cloudsFilePaths("OS_CLIENT_CONFIG_FILE", "clouds"); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths %v, got %v", expected, paths)
+	}
+
+	setEnv(t, map[string]string{"OS_CLIENT_CONFIG_FILE": "", "XDG_CONFIG_HOME": "", "HOME": "/home/user"})
+	if paths := cloudsFilePaths("OS_CLIENT_CONFIG_FILE", "clouds"); len(paths) != 6 || paths[2] != "/home/user/.config/openstack/clouds.yaml" {
+		t.Errorf("expected the user configuration to be read from HOME, got %v", paths)
+	}
+}
+
+func TestLoadCloud(t *testing.T) {
+	writeCloudsFiles(t, `
+clouds:
+  mycloud:
+    auth_type: v3password
+    auth:
+      auth_url: http://keystone/v3
+      username: user
+      tenant_name: tenant
+      project_name: project
+      user_domain_name: Default
+    region_name: R1
+    endpoint_type: publicURL
+    interface: internal
+    verify: false
+  other:
+    auth:
+      auth_url: http://other/v3
+`, `
+clouds:
+  mycloud:
+    auth:
+      password: secret
+`)
+
+	cloud, err := loadCloud("mycloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.Auth.AuthURL != "http://keystone/v3" || cloud.Auth.Password != "secret" {
+		t.Errorf("expected secure.yaml to be merged into the cloud, got %+v", cloud.Auth)
+	}
+
+	config := defaultConfig()
+	config.Auth.Username = "overridden"
+	config.Auth.Password = "kept"
+	config.applyCloud(cloud)
+	auth := config.Auth
+	if auth.Username != "user" || auth.Password != "secret" || auth.ProjectName != "project" || auth.UserDomainName != "Default" || auth.Type != "v3password" {
+		t.Errorf("unexpected credentials from the cloud: %+v", auth)
+	}
+	if config.Region != "R1" || config.Interface != "internal" || !config.Insecure {
+		t.Errorf("expected region R1, interface internal and verification disabled, got %q, %q and %v", config.Region, config.Interface, config.Insecure)
+	}
+
+	if _, err := loadCloud("missing"); err == nil || !strings.Contains(err.Error(), `cloud "missing" not found`) {
+		t.Errorf("expected a missing cloud to be reported, got %v", err)
+	}
+}
+
+func TestLoadCloudWithoutFile(t *testing.T) {
+	writeCloudsFiles(t, "", "")
+	dir, err := ioutil.TempDir("", "cwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if wd, err := os.Getwd(); err == nil {
+		defer os.Chdir(wd)
+	}
+	os.Chdir(dir)
+
+	if _, err := os.Stat("/etc/openstack"); err == nil {
+		t.Skip("/etc/openstack exists on this host")
+	}
+	if _, err := loadCloud("mycloud"); err == nil || !strings.Contains(err.Error(), "no clouds.yaml was found") {
+		t.Errorf("expected the missing clouds.yaml to be reported, got %v", err)
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	base := map[string]interface{}{
+		"clouds": map[string]interface{}{
+			"a": map[string]interface{}{"auth": map[string]interface{}{"username": "user", "password": "old"}, "region_name": "R1"},
+		},
+	}
+	override := map[string]interface{}{
+		"clouds": map[string]interface{}{
+			"a": map[string]interface{}{"auth": map[string]interface{}{"password": "new"}},
+			"b": map[string]interface{}{"region_name": "R2"},
+		},
+	}
+	expected := map[string]interface{}{
+		"clouds": map[string]interface{}{
+			"a": map[string]interface{}{"auth": map[string]interface{}{"username": "user", "password": "new"}, "region_name": "R1"},
+			"b": map[string]interface{}{"region_name": "R2"},
+		},
+	}
+	if merged := mergeMaps(base, override); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected %v, got %v", expected, merged)
+	}
+	if password := base["clouds"].(map[string]interface{})["a"].(map[string]interface{})["auth"].(map[string]interface{})["password"]; password != "old" {
+		t.Errorf("expected the base not to be modified, got password %v", password)
+	}
+}
+
+func TestResolveTargetsWithClouds(t *testing.T) {
+	writeCloudsFiles(t, `
+clouds:
+  east:
+    auth:
+      auth_url: http://east/v3
+      username: east-user
+    region_name: east
+  west:
+    auth:
+      auth_url: http://west/v3
+    region_name: west
+`, "")
+
+	config := readTestConfig(t, `
+auth:
+  password: secret
+clouds:
+  - cloud: east
+  - cloud: west
+    region: west-2
+`)
+	if err := config.resolveTargets(); err != nil {
+		t.Fatal(err)
+	}
+	east, west := config.targets[0], config.targets[1]
+	if east.Name != "east" || east.Auth.AuthURL != "http://east/v3" || east.Auth.Username != "east-user" || east.Auth.Password != "secret" || east.Region != "east" {
+		t.Errorf("unexpected settings of cloud east: %+v", east)
+	}
+	// Settings given in the entry take precedence over clouds.yaml
+	if west.Name != "west" || west.Auth.AuthURL != "http://west/v3" || west.Region != "west-2" {
+		t.Errorf("unexpected settings of cloud west: %+v", west)
+	}
+
+	config = readTestConfig(t, `
+clouds:
+  - cloud: missing
+`)
+	if err := config.resolveTargets(); err == nil || !strings.HasPrefix(err.Error(), config.filename+":3:12: ") {
+		t.Errorf("expected an error at the cloud setting, got %v", err)
+	}
+}
+
+func TestResolveTargetsWithOtherCloud(t *testing.T) {
+	writeCloudsFiles(t, `
+clouds:
+  a:
+    auth_type: v3applicationcredential
+    auth:
+      auth_url: http://a/v3
+      application_credential_id: appid
+      application_credential_secret: appsecret
+    region_name: ra
+    verify: false
+  b:
+    auth:
+      auth_url: http://b/v3
+      username: user
+      password: secret
+      project_name: project
+`, "")
+
+	config := readTestConfig(t, `
+cloud: a
+clouds:
+  - name: first
+  - name: second
+    cloud: b
+`)
+	cloud, err := loadCloud("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.applyCloud(cloud)
+	if err := config.resolveTargets(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := config.targets[0], config.targets[1]
+	if first.Auth.method() != authApplicationCredential || first.Auth.ApplicationCredentialID != "appid" || first.Region != "ra" || !first.Insecure {
+		t.Errorf("expected the first cloud to inherit cloud a, got %+v", first)
+	}
+	// Nothing of cloud a is used to authenticate against cloud b
+	auth := second.Auth
+	if auth.method() != authPassword || auth.ApplicationCredentialID != "" || auth.ApplicationCredentialSecret != "" || auth.AuthURL != "http://b/v3" || auth.Username != "user" {
+		t.Errorf("expected the second cloud to use the password of cloud b, got %+v", auth)
+	}
+	if second.Region != "" || second.Insecure {
+		t.Errorf("expected the second cloud not to inherit the region and verification of cloud a, got %q and %v", second.Region, second.Insecure)
+	}
+}
+
+func TestResolveTargetsUnknownFields(t *testing.T) {
+	config := defaultConfig()
+	config.filename = "config.yml"
+	config.root = &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("clouds:\n  - name: a\n    regoin: R2\n"), config.root); err != nil {
+		t.Fatal(err)
+	}
+	err := config.resolveTargets()
+	if err == nil || !strings.HasPrefix(err.Error(), "config.yml:2:5: ") || !strings.Contains(err.Error(), "field regoin not found") {
+		t.Errorf("expected an error at the entry with the unknown field, got %v", err)
+	}
+}
+
+func TestNormalizeAuthType(t *testing.T) {
+	for authType, expected := range map[string]string{
+		"v2password":  authPassword,
+		"v3password":  authPassword,
+		"v3token":     authToken,
+		"admin_token": authTokenEndpoint,
+		"password":    "password",
+	} {
+		if normalized := normalizeAuthType(authType); normalized != expected {
+			t.Errorf("expected %s to be normalized to %s, got %s", authType, expected, normalized)
+		}
+	}
+}
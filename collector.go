@@ -0,0 +1,852 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/golang/protobuf/proto"
+	"github.com/rackspace/gophercloud"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func makeFQName(metric string) string {
+	return fmt.Sprintf("%s_%s", namespace, metric)
+}
+
+const (
+	// Bounds of the delay between attempts to connect to a cloud that is unavailable at startup
+	minConnectBackoff = 5 * time.Second
+	maxConnectBackoff = 5 * time.Minute
+)
+
+// openstackCloud holds the clients for a configured cloud, shared by all collectors scraping it.
+// If the cloud cannot be reached at startup, connecting is retried in the background and the
+// collectors only report it as down until it succeeds.
+type openstackCloud struct {
+	config    *Config
+	lookupSvc LookupService
+
+	mu        sync.RWMutex
+	connected bool
+	session   *keystoneSession
+	client    *gophercloud.ServiceClient
+	endpoints map[string]string
+	// alarmClient and eventClient are nil if there is no alarms or events API
+	alarmClient *gophercloud.ServiceClient
+	eventClient *gophercloud.ServiceClient
+
+	// poller scrapes the meters with a poll interval in the background, if there are any
+	poller *meterPoller
+	// events counts the events of the cloud, if they are enabled
+	events *eventCounter
+	// discovery lists the meters available in the cloud, if enabled
+	discovery *meterDiscovery
+
+	// timestamps holds the exported sample times of each meter, shared by all collectors of
+	// the cloud so that they survive across probes
+	timestampsMu sync.Mutex
+	timestamps   map[string]*seriesTimestamps
+}
+
+func NewOpenstackCloud(config *Config) *openstackCloud {
+	cloud := &openstackCloud{config: config}
+	if err := cloud.connect(); err != nil {
+		log.Errorf("Failed to connect to cloud %s, retrying in the background: %v", config.Name, err)
+		go cloud.connectLoop()
+	}
+	return cloud
+}
+
+// connect authenticates and sets up the service clients. Only the telemetry service is
+// required; if compute or network are missing, the lookups using them are disabled, and if
+// there is no alarms or events API, alarms or events are not exported. It is not
+// called concurrently, so the lock is only held while publishing the results.
+func (c *openstackCloud) connect() error {
+	// The session is kept if a later step fails, as it already renews its own token
+	c.mu.RLock()
+	session := c.session
+	c.mu.RUnlock()
+	if session == nil {
+		var err error
+		session, err = NewKeystoneSession(c.config)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.session = session
+		c.mu.Unlock()
+	}
+
+	client, err := newStorageClient(session.provider, c.config)
+	if err != nil {
+		return err
+	}
+
+	alarmClient := newSplitServiceClient(session.provider, c.config, alarmingServiceType, client)
+	eventClient := newSplitServiceClient(session.provider, c.config, eventServiceType, client)
+
+	endpoints := map[string]string{c.config.storageServiceType(): client.Endpoint}
+	if alarmClient != nil && alarmClient != client {
+		endpoints[alarmingServiceType] = alarmClient.Endpoint
+	}
+	if eventClient != nil && eventClient != client {
+		endpoints[eventServiceType] = eventClient.Endpoint
+	}
+	for serviceType, url := range endpoints {
+		log.Infof("Using %s endpoint %s for cloud %s", serviceType, url, c.config.Name)
+	}
+
+	// The lookup service is kept across connections, and only sets up the lookups it lacks
+	c.lookupSvc.connect(session.provider, c.config.endpointOpts(), c.config.Lookup)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = client
+	c.alarmClient = alarmClient
+	c.eventClient = eventClient
+	c.endpoints = endpoints
+	c.connected = true
+	return nil
+}
+
+func (c *openstackCloud) connectLoop() {
+	backoff := minConnectBackoff
+	for {
+		time.Sleep(backoff)
+		err := c.connect()
+		if err == nil {
+			log.Infof("Connected to cloud %s", c.config.Name)
+			return
+		}
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+		log.Warnf("Failed to connect to cloud %s, retrying in %v: %v", c.config.Name, backoff, err)
+	}
+}
+
+// metaMetricNames returns the names of the metrics the exporter exports about itself and the
+// cloud, rather than for a meter, taken from the descriptions of the collectors.
+func metaMetricNames() map[string]bool {
+	cloud := &openstackCloud{config: defaultConfig()}
+	collectors := []prometheus.Collector{
+		NewCeilometerCollector(cloud, MetricSelection{}),
+		NewAlarmCollector(cloud),
+		NewEventCollector(cloud),
+		NewResourceCollector(cloud),
+	}
+	names := make(map[string]bool)
+	for _, collector := range collectors {
+		for _, desc := range describe(collector) {
+			if name, _, err := descNameAndHelp(desc); err == nil {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+func (c *openstackCloud) constLabels() prometheus.Labels {
+	return prometheus.Labels{"cloud": c.config.Name, "region": c.config.Region}
+}
+
+// metrics builds the meters of the cloud that are chosen by selection, with their settings.
+func (c *openstackCloud) metrics(selection MetricSelection) map[string]ceilometerMetric {
+	allMetrics := *getMetrics(c.config.definitions, &c.lookupSvc, c.constLabels())
+	filteredMetrics := make(map[string]ceilometerMetric)
+	for name, metric := range allMetrics {
+		if selection.shouldUseMetric(name) {
+			filteredMetrics[name] = c.configureMetric(name, metric)
+		}
+	}
+	return filteredMetrics
+}
+
+// configureMetric applies the settings of the named meter to metric.
+func (c *openstackCloud) configureMetric(name string, metric ceilometerMetric) ceilometerMetric {
+	metric.settings = c.config.meterConfig(name)
+	metric.backend = newStorageBackend(c.config.Backend)
+	// Rates aggregated by Gnocchi from cumulative meters are no longer counters
+	if c.config.Backend == backendGnocchi && strings.HasPrefix(metric.settings.Aggregation, "rate:") {
+		if metric.valueType != nil && *metric.valueType == prometheus.CounterValue {
+			gauge := prometheus.GaugeValue
+			metric.valueType = &gauge
+		}
+		if metric.sampleType == "cumulative" {
+			metric.sampleType = "gauge"
+		}
+	}
+	if *metric.settings.SampleTimestamps && metric.desc != nil {
+		metric.timestamps = c.seriesTimestamps(name)
+	}
+	return metric
+}
+
+// seriesTimestamps returns the exported sample times of the named meter.
+func (c *openstackCloud) seriesTimestamps(name string) *seriesTimestamps {
+	c.timestampsMu.Lock()
+	defer c.timestampsMu.Unlock()
+	if c.timestamps == nil {
+		c.timestamps = make(map[string]*seriesTimestamps)
+	}
+	timestamps, ok := c.timestamps[name]
+	if !ok {
+		timestamps = newSeriesTimestamps()
+		c.timestamps[name] = timestamps
+	}
+	return timestamps
+}
+
+// NewCeilometerCollector creates a collector for the metrics of cloud that are chosen by selection.
+func NewCeilometerCollector(cloud *openstackCloud, selection MetricSelection) *ceilometerCollector {
+	constLabels := cloud.constLabels()
+	return &ceilometerCollector{
+		metrics:    cloud.metrics(selection),
+		selection:  selection,
+		discovered: make(map[string]ceilometerMetric),
+		metaMetrics: map[string]*prometheus.Desc{
+			"scrapeSuccess":    prometheus.NewDesc(makeFQName("metric_scrape_success"), "Indicates if the metric was successfully scraped", []string{"metric"}, constLabels),
+			"scrapeDuration":   prometheus.NewDesc(makeFQName("metric_scrape_duration_ns"), "The time taken to scrape the metric", []string{"metric"}, constLabels),
+			"scrapeResultSize": prometheus.NewDesc(makeFQName("metric_scrape_result_size"), "Number of results returned by the metric query", []string{"metric"}, constLabels),
+			"scrapeTruncated":  prometheus.NewDesc(makeFQName("metric_scrape_truncated"), "Indicates if the samples of the metric were truncated by max_samples", []string{"metric"}, constLabels),
+			"scrapeTimeout":    prometheus.NewDesc(makeFQName("metric_scrape_timeout"), "Indicates if the scrape of the metric failed by exceeding the scrape or meter timeout", []string{"metric"}, constLabels),
+			"oldestSampleAge":  prometheus.NewDesc(makeFQName("metric_oldest_sample_age_seconds"), "Age of the oldest exported sample of the metric, showing the series updated least recently", []string{"metric"}, constLabels),
+			"newestSampleAge":  prometheus.NewDesc(makeFQName("metric_newest_sample_age_seconds"), "Age of the newest exported sample of the metric", []string{"metric"}, constLabels),
+			"outOfOrder":       prometheus.NewDesc(makeFQName("metric_out_of_order_samples_total"), "Number of samples not exported as they were older than one already exported for the series", []string{"metric"}, constLabels),
+			"pollAge":          prometheus.NewDesc(makeFQName("metric_poll_age_seconds"), "Time since the last successful background poll of the metric, whose results are served", []string{"metric"}, constLabels),
+
+			"totalScrapeDuration": prometheus.NewDesc(makeFQName("total_scrape_duration_ns"), "Time taken for entire scrape", nil, constLabels),
+
+			"tokenExpiry":            prometheus.NewDesc(makeFQName("token_expiry_timestamp_seconds"), "Expiry time of the current Keystone token", nil, constLabels),
+			"tokenReauthentications": prometheus.NewDesc(makeFQName("token_reauthentications_total"), "Number of times the Keystone token has been renewed", nil, constLabels),
+			"tokenReauthFailures":    prometheus.NewDesc(makeFQName("token_reauthentication_failures_total"), "Number of failed attempts to renew the Keystone token", nil, constLabels),
+
+			"lookupCacheEntries":         prometheus.NewDesc(makeFQName("lookup_cache_entries"), "Number of names held in the lookup cache", []string{"kind"}, constLabels),
+			"lookupCacheHits":            prometheus.NewDesc(makeFQName("lookup_cache_hits_total"), "Number of lookups answered from the cache", []string{"kind"}, constLabels),
+			"lookupCacheMisses":          prometheus.NewDesc(makeFQName("lookup_cache_misses_total"), "Number of lookups that required a request to OpenStack", []string{"kind"}, constLabels),
+			"lookupCacheRefreshDuration": prometheus.NewDesc(makeFQName("lookup_cache_refresh_duration_seconds"), "Time taken by the last refresh of the lookup cache", []string{"kind"}, constLabels),
+			"lookupCacheRefreshFailures": prometheus.NewDesc(makeFQName("lookup_cache_refresh_failures_total"), "Number of failed refreshes of the lookup cache", []string{"kind"}, constLabels),
+
+			"endpointInfo": prometheus.NewDesc(makeFQName("endpoint_info"), "Endpoints used for each service", []string{"service", "url", "interface"}, constLabels),
+
+			"meterAvailable":           prometheus.NewDesc(makeFQName("meter_available"), "Whether the meter is available in the cloud, for the defined meters and those discovered without a definition", []string{"meter", "defined"}, constLabels),
+			"discoveryAge":             prometheus.NewDesc(makeFQName("meter_discovery_age_seconds"), "Time since the available meters were last listed", nil, constLabels),
+			"discoveryRefreshFailures": prometheus.NewDesc(makeFQName("meter_discovery_failures_total"), "Number of failed attempts to list the available meters", nil, constLabels),
+
+			"up":            prometheus.NewDesc(makeFQName("up"), "Whether the exporter has authenticated and found the telemetry endpoint", nil, constLabels),
+			"lookupEnabled": prometheus.NewDesc(makeFQName("lookup_enabled"), "Whether name lookups against the service are enabled. Meters depending on a disabled service are not scraped.", []string{"service"}, constLabels),
+		},
+		cloud: cloud,
+	}
+}
+
+type ceilometerCollector struct {
+	cloud       *openstackCloud
+	metrics     map[string]ceilometerMetric
+	selection   MetricSelection
+	metaMetrics map[string]*prometheus.Desc
+
+	// discovered holds the meters without a definition found by the discovery of the cloud,
+	// kept across scrapes rather than built again each time
+	mu         sync.Mutex
+	discovered map[string]ceilometerMetric
+}
+type ceilometerMetric struct {
+	desc          *prometheus.Desc
+	extractLabels func(context.Context, *meters.OldSample) []string
+	// identity holds the positions of the labels identifying a series, or nil for all labels
+	identity []int
+	settings MeterConfig
+	backend  storageBackend
+	// requires lists the service types used for name lookups by extractLabels
+	requires []string
+	// valueType overrides the type given by the samples, if set
+	valueType *prometheus.ValueType
+	// sampleType is the type of the samples that have none, if set
+	sampleType string
+	scale      float64
+	// statistics holds the descriptions of the exported statistics, if the meter is scraped
+	// through the statistics API rather than as samples
+	statistics map[string]*prometheus.Desc
+	groupBy    []string
+	// timestamps tracks the exported sample times, if metrics are exported with them
+	timestamps *seriesTimestamps
+}
+
+func (c *ceilometerCollector) Describe(ch chan<- *prometheus.Desc) {
+	log.Debugf("Sending %d metrics descriptions", len(c.metrics)+len(c.metaMetrics))
+	for _, metric := range c.metrics {
+		if metric.desc != nil {
+			ch <- metric.desc
+		}
+		for _, desc := range metric.statistics {
+			ch <- desc
+		}
+	}
+	for _, metric := range c.metaMetrics {
+		ch <- metric
+	}
+}
+
+func (c *ceilometerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+// CollectWithContext scrapes all meters, stopping requests still in flight when ctx is done.
+// It only returns once every meter has been handled, as their metrics are sent to ch.
+func (c *ceilometerCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t := time.Now()
+
+	// The cloud is not locked during the scrape, so that it can reconnect meanwhile
+	cloud := c.cloud
+	cloud.mu.RLock()
+	connected, client, session, endpoints := cloud.connected, cloud.client, cloud.session, cloud.endpoints
+	cloud.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["up"], prometheus.GaugeValue, btof(connected))
+	if !connected {
+		return
+	}
+
+	for _, serviceType := range []string{computeServiceType, networkServiceType} {
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupEnabled"], prometheus.GaugeValue, btof(cloud.lookupSvc.enabled(serviceType)), serviceType)
+	}
+
+	metrics := c.metrics
+	if cloud.discovery != nil {
+		metrics = c.withDiscovered(ch, t)
+	}
+
+	result := make(chan scrapeStats)
+	defer close(result)
+	scraped := 0
+	for resourceLabel, metric := range metrics {
+		if serviceType, ok := cloud.lookupSvc.missing(metric.requires); ok {
+			log.Debugf("Skipping %s, as %s lookups are disabled", resourceLabel, serviceType)
+			continue
+		}
+		if metric.settings.PollInterval > 0 {
+			c.sendPolled(ch, resourceLabel, metric, t)
+			continue
+		}
+		go scrape(ctx, resourceLabel, metric, client, ch, result)
+		scraped++
+	}
+	for i := 0; i < scraped; i++ {
+		scrapeStats := <-result
+		c.sendScrapeStats(ch, scrapeStats, metrics[scrapeStats.resourceLabel].timestamps, t)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["totalScrapeDuration"], prometheus.GaugeValue, float64(time.Since(t).Nanoseconds()))
+
+	sessionStats := session.stats()
+	// Tokens given in the configuration have no known expiry
+	if !sessionStats.expiresAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["tokenExpiry"], prometheus.GaugeValue, float64(sessionStats.expiresAt.Unix()))
+	}
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["tokenReauthentications"], prometheus.CounterValue, float64(sessionStats.reauthCount))
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["tokenReauthFailures"], prometheus.CounterValue, float64(sessionStats.reauthFailures))
+
+	for _, cache := range cloud.lookupSvc.caches() {
+		cacheStats := cache.stats()
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupCacheEntries"], prometheus.GaugeValue, float64(cacheStats.entries), cache.kind)
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupCacheHits"], prometheus.CounterValue, float64(cacheStats.hits), cache.kind)
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupCacheMisses"], prometheus.CounterValue, float64(cacheStats.misses), cache.kind)
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupCacheRefreshDuration"], prometheus.GaugeValue, cacheStats.refreshDuration.Seconds(), cache.kind)
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["lookupCacheRefreshFailures"], prometheus.CounterValue, float64(cacheStats.refreshFailures), cache.kind)
+	}
+
+	endpointOpts := cloud.config.endpointOpts()
+	for _, endpoints := range []map[string]string{endpoints, cloud.lookupSvc.endpoints()} {
+		for serviceType, url := range endpoints {
+			ch <- prometheus.MustNewConstMetric(c.metaMetrics["endpointInfo"], prometheus.GaugeValue, 1, serviceType, url, string(endpointOpts.Availability))
+		}
+	}
+}
+
+func btof(b bool) float64 {
+	if b {
+		return 1.0
+	} else {
+		return 0.0
+	}
+}
+
+type scrapeStats struct {
+	resourceLabel string
+	success       bool
+	truncated     bool
+	duration      time.Duration
+	resultSize    int
+	// timedOut is set if the scrape failed due to the scrape or meter timeout
+	timedOut bool
+	// Timestamps of the oldest and newest exported samples, zero if there were none
+	oldestSample time.Time
+	newestSample time.Time
+}
+
+// sendScrapeStats sends the metrics describing the scrape of a meter at time t.
+func (c *ceilometerCollector) sendScrapeStats(ch chan<- prometheus.Metric, stats scrapeStats, timestamps *seriesTimestamps, t time.Time) {
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeSuccess"], prometheus.GaugeValue, btof(stats.success), stats.resourceLabel)
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeDuration"], prometheus.GaugeValue, float64(stats.duration.Nanoseconds()), stats.resourceLabel)
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeResultSize"], prometheus.GaugeValue, float64(stats.resultSize), stats.resourceLabel)
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeTruncated"], prometheus.GaugeValue, btof(stats.truncated), stats.resourceLabel)
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeTimeout"], prometheus.GaugeValue, btof(stats.timedOut), stats.resourceLabel)
+	if !stats.oldestSample.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["oldestSampleAge"], prometheus.GaugeValue, t.Sub(stats.oldestSample).Seconds(), stats.resourceLabel)
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["newestSampleAge"], prometheus.GaugeValue, t.Sub(stats.newestSample).Seconds(), stats.resourceLabel)
+	}
+	if timestamps != nil {
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["outOfOrder"], prometheus.CounterValue, float64(timestamps.outOfOrderCount()), stats.resourceLabel)
+	}
+}
+
+// sendPolled sends the results of the latest background poll of a meter. The metrics of the
+// last successful poll are served until they are older than max_metric_age, as a scrape would
+// no longer have returned their samples.
+func (c *ceilometerCollector) sendPolled(ch chan<- prometheus.Metric, resourceLabel string, metric ceilometerMetric, t time.Time) {
+	polled, ok := c.cloud.poller.result(resourceLabel)
+	if !ok {
+		log.Debugf("Skipping %s, as it has not been polled yet", resourceLabel)
+		return
+	}
+	if !polled.updated.IsZero() {
+		age := t.Sub(polled.updated)
+		if age <= metric.settings.MaxMetricAge {
+			for _, m := range polled.metrics {
+				ch <- m
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["pollAge"], prometheus.GaugeValue, age.Seconds(), resourceLabel)
+	}
+	c.sendScrapeStats(ch, polled.stats, polled.timestamps, t)
+}
+
+// withDiscovered returns the meters of the collector along with the discovered meters without a
+// definition that are chosen by its selection, and sends the availability of both. Discovered
+// meters are always scraped on demand, as the poller only knows the defined ones.
+func (c *ceilometerCollector) withDiscovered(ch chan<- prometheus.Metric, t time.Time) map[string]ceilometerMetric {
+	cloud := c.cloud
+	refreshed, refreshFailures := cloud.discovery.stats()
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["discoveryRefreshFailures"], prometheus.CounterValue, float64(refreshFailures))
+	available, definitions, ok := cloud.discovery.meters()
+	if !ok {
+		return c.metrics
+	}
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["discoveryAge"], prometheus.GaugeValue, t.Sub(refreshed).Seconds())
+
+	for name := range c.metrics {
+		ch <- prometheus.MustNewConstMetric(c.metaMetrics["meterAvailable"], prometheus.GaugeValue, btof(available[name]), name, "true")
+	}
+	for name := range available {
+		if _, defined := cloud.config.definitions[name]; !defined {
+			ch <- prometheus.MustNewConstMetric(c.metaMetrics["meterAvailable"], prometheus.GaugeValue, 1, name, "false")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metrics := make(map[string]ceilometerMetric, len(c.metrics)+len(definitions))
+	for name, metric := range c.metrics {
+		metrics[name] = metric
+	}
+	for name := range c.discovered {
+		if _, ok := definitions[name]; !ok {
+			delete(c.discovered, name)
+		}
+	}
+	for name, definition := range definitions {
+		if !c.selection.shouldUseMetric(name) {
+			continue
+		}
+		metric, ok := c.discovered[name]
+		if !ok {
+			metric = cloud.configureMetric(name, definition.build(&cloud.lookupSvc, cloud.constLabels()))
+			metric.settings.PollInterval = 0
+			c.discovered[name] = metric
+		}
+		metrics[name] = metric
+	}
+	return metrics
+}
+
+// The timestamp format used in queries
+const timestampFormat = "2006-01-02T15:04:05.999999"
+
+// parseTimestamp parses timestamps returned by the telemetry APIs, which Ceilometer gives
+// without a time zone and the services split from it may give with one. All are in UTC.
+func parseTimestamp(value string) (time.Time, error) {
+	if timestamp, err := time.Parse(timestampFormat, value); err == nil {
+		return timestamp, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func sendStats(ch chan<- scrapeStats, stats *scrapeStats) {
+	ch <- *stats
+}
+func registerDuration(start time.Time, stats *scrapeStats) {
+	stats.duration = time.Since(start)
+}
+
+func scrape(ctx context.Context, resourceLabel string, metric ceilometerMetric, client *gophercloud.ServiceClient, ch chan<- prometheus.Metric, result chan<- scrapeStats) {
+	t := time.Now()
+	stats := scrapeStats{resourceLabel: resourceLabel}
+	defer sendStats(result, &stats)
+	defer registerDuration(t, &stats)
+
+	if metric.settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, metric.settings.Timeout)
+		defer cancel()
+	}
+	client = withContext(ctx, client)
+
+	if metric.statistics != nil {
+		scrapeStatistics(ctx, resourceLabel, metric, client, ch, &stats)
+		return
+	}
+
+	data, truncated, err := metric.backend.samples(client, resourceLabel, metric.settings)
+	stats.truncated = truncated
+	if err != nil {
+		stats.timedOut = ctx.Err() == context.DeadlineExceeded
+		log.Warnf("Failed to scrape Ceilometer resource %q: %v", resourceLabel, err)
+		return
+	}
+	if len(data) == 0 {
+		log.Warnf("Query for %v returned no results!", resourceLabel)
+		stats.success = true // The query itself was successful, even though no results were produced
+		return
+	}
+	if truncated {
+		log.Warnf("Query for %v reached the maximum number of samples (%d), data may be truncated", resourceLabel, metric.settings.MaxSamples)
+	}
+	series := deduplicate(ctx, data, metric)
+	log.Debugf("Query for %s returned %d results, %d remain after deduplication", resourceLabel, len(data), len(series))
+	stats.resultSize = len(series)
+
+	now := time.Now()
+	if metric.timestamps != nil {
+		metric.timestamps.expire(now.Add(-metric.settings.MaxMetricAge))
+	}
+	for _, s := range series {
+		if stats.oldestSample.IsZero() || s.sample.Timestamp.Before(stats.oldestSample) {
+			stats.oldestSample = s.sample.Timestamp
+		}
+		if s.sample.Timestamp.After(stats.newestSample) {
+			stats.newestSample = s.sample.Timestamp
+		}
+		m := sampleToMetric(s.sample, s.labels, metric)
+		if metric.timestamps != nil {
+			// Clock skew could put samples in the future, which Prometheus rejects
+			timestamp := s.sample.Timestamp
+			if timestamp.After(now) {
+				timestamp = now
+			}
+			if !metric.timestamps.accept(seriesKey(s.labels, nil), timestamp) {
+				log.Debugf("Skipping sample of %s at %v, as a newer one has been exported for %v", resourceLabel, timestamp, s.labels)
+				continue
+			}
+			m = timestampedMetric{m, timestamp}
+		}
+		ch <- m
+	}
+
+	stats.success = true
+}
+
+// fetchSamples pages through the samples of a meter in the query window. The API has no
+// markers, but returns the newest samples first, so each page continues from the oldest
+// timestamp of the previous one. Samples at that timestamp are returned again, and are skipped
+// by their message id. The result is truncated after settings.MaxSamples samples.
+func fetchSamples(client *gophercloud.ServiceClient, meterName string, settings MeterConfig) ([]meters.OldSample, bool, error) {
+	windowStart := time.Now().UTC().Add(-settings.MaxMetricAge)
+	op, bound := "gt", windowStart
+
+	var samples []meters.OldSample
+	seen := make(map[string]bool)
+	for {
+		page, err := querySamples(client, meterName, settings, op, bound)
+		if err != nil {
+			return nil, false, err
+		}
+
+		added := 0
+		windowEnded := false
+		for _, sample := range page {
+			if sample.Timestamp.Before(windowStart) || sample.Timestamp.Equal(windowStart) {
+				windowEnded = true
+				continue
+			}
+			key := sample.MessageId
+			if key == "" {
+				key = sample.ResourceId + "@" + sample.Timestamp.String()
+			}
+			if seen[key] {
+				continue
+			}
+			if len(samples) >= settings.MaxSamples {
+				return samples, true, nil
+			}
+			seen[key] = true
+			samples = append(samples, sample)
+			added++
+		}
+
+		if len(page) < settings.MaxResults || windowEnded {
+			return samples, false, nil
+		}
+		oldest := page[len(page)-1].Timestamp
+		if added == 0 || oldest.IsZero() {
+			// A full page of samples with the same timestamp cannot be continued from
+			log.Warnf("Cannot continue paging through %v after %v", meterName, oldest)
+			return samples, true, nil
+		}
+		op, bound = "le", oldest
+	}
+}
+
+// querySamples fetches a page of the newest samples of a meter with a timestamp compared to
+// bound by op, that also match the filters of the meter. The simple query API cannot express
+// the in operator, so filters using it are sent as a complex query instead.
+func querySamples(client *gophercloud.ServiceClient, meterName string, settings MeterConfig, op string, bound time.Time) ([]meters.OldSample, error) {
+	if !usesComplexQuery(settings.Filters) {
+		query := meters.ShowOpts{
+			QueryField: "timestamp",
+			QueryOp:    op,
+			QueryValue: bound.Format(timestampFormat),
+			Query:      filterPredicates(settings.Filters),
+			Limit:      settings.MaxResults,
+		}
+		log.Debugf("Querying for %v: %v", meterName, query)
+		return meters.Show(client, meterName, query).Extract()
+	}
+
+	conditions := []interface{}{
+		complexCondition("eq", "counter_name", meterName),
+		complexCondition(op, "timestamp", bound.Format(timestampFormat)),
+	}
+	for _, filter := range settings.Filters {
+		// Complex queries name metadata fields as the group by of statistics queries does
+		field := statisticsQueryField(filter.Field)
+		if filter.op() == "in" {
+			conditions = append(conditions, complexCondition("in", field, filter.Values))
+		} else {
+			conditions = append(conditions, complexCondition(filter.op(), field, filter.Value))
+		}
+	}
+	query := meters.QuerySamplesOpts{
+		Filter:  map[string]interface{}{"and": conditions},
+		OrderBy: []map[string]string{{"timestamp": "desc"}},
+		Limit:   settings.MaxResults,
+	}
+	log.Debugf("Querying for %v: %v", meterName, query)
+	results, err := meters.QuerySamples(client, query).Extract()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]meters.OldSample, len(results))
+	for i, result := range results {
+		samples[i] = result.ToOldSample()
+	}
+	return samples, nil
+}
+
+// complexQueryOps maps the operators of simple queries to those of complex queries.
+var complexQueryOps = map[string]string{
+	"eq": "=",
+	"ne": "!=",
+	"lt": "<",
+	"le": "<=",
+	"gt": ">",
+	"ge": ">=",
+	"in": "in",
+}
+
+func complexCondition(op, field string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{complexQueryOps[op]: map[string]interface{}{field: value}}
+}
+
+func usesComplexQuery(filters []FilterConfig) bool {
+	for _, filter := range filters {
+		if filter.op() == "in" {
+			return true
+		}
+	}
+	return false
+}
+
+func filterPredicates(filters []FilterConfig) []meters.Predicate {
+	var predicates []meters.Predicate
+	for _, filter := range filters {
+		predicates = append(predicates, meters.Predicate{Field: filter.Field, Op: filter.op(), Value: filter.Value})
+	}
+	return predicates
+}
+
+func scrapeStatistics(ctx context.Context, resourceLabel string, metric ceilometerMetric, client *gophercloud.ServiceClient, ch chan<- prometheus.Metric, stats *scrapeStats) {
+	data, err := metric.backend.statistics(client, resourceLabel, metric.settings, metric.groupBy)
+	if err != nil {
+		stats.timedOut = ctx.Err() == context.DeadlineExceeded
+		log.Warnf("Failed to scrape statistics of Ceilometer resource %q: %v", resourceLabel, err)
+		return
+	}
+	if len(data) == 0 {
+		log.Warnf("Statistics query for %v returned no results!", resourceLabel)
+	}
+	stats.resultSize = len(data)
+
+	for _, group := range data {
+		labels := metric.extractLabels(ctx, groupToSample(group.GroupBy))
+		for statistic, desc := range metric.statistics {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, statisticValue(&group, statistic, metric.scale), labels...)
+		}
+	}
+
+	stats.success = true
+}
+
+// statisticValue returns the named statistic. All but the count are in the unit of the meter,
+// and are scaled accordingly.
+func statisticValue(statistics *meters.Statistics, statistic string, scale float64) float64 {
+	switch statistic {
+	case "avg":
+		return statistics.Avg * scale
+	case "min":
+		return statistics.Min * scale
+	case "max":
+		return statistics.Max * scale
+	case "sum":
+		return statistics.Sum * scale
+	}
+	return float64(statistics.Count)
+}
+
+// labeledSample is a sample along with the values of the labels it is exported with.
+type labeledSample struct {
+	sample *meters.OldSample
+	labels []string
+}
+
+// deduplicate keeps the newest sample of each series, in the order the series were first seen.
+// Samples belong to the same series if they have the same values of the identity labels of the
+// metric.
+func deduplicate(ctx context.Context, samples []meters.OldSample, metric ceilometerMetric) []labeledSample {
+	var unique []labeledSample
+	seen := make(map[string]int)
+	for i := range samples {
+		sample := &samples[i]
+		labels := metric.extractLabels(ctx, sample)
+		key := seriesKey(labels, metric.identity)
+		if j, ok := seen[key]; !ok {
+			seen[key] = len(unique)
+			unique = append(unique, labeledSample{sample, labels})
+		} else if sample.Timestamp.After(unique[j].sample.Timestamp) {
+			unique[j] = labeledSample{sample, labels}
+		}
+	}
+	return unique
+}
+
+func seriesKey(labels []string, identity []int) string {
+	if identity == nil {
+		return strings.Join(labels, "\xff")
+	}
+	values := make([]string, len(identity))
+	for i, index := range identity {
+		values[i] = labels[index]
+	}
+	return strings.Join(values, "\xff")
+}
+
+// seriesTimestamps holds the timestamp last exported for each series of a metric. Prometheus
+// rejects samples older than one it already has for a series, so these are not exported.
+type seriesTimestamps struct {
+	mu         sync.Mutex
+	last       map[string]time.Time
+	outOfOrder int
+}
+
+func newSeriesTimestamps() *seriesTimestamps {
+	return &seriesTimestamps{last: make(map[string]time.Time)}
+}
+
+// accept tells if a sample of the series may be exported with the timestamp, and records it if so.
+func (t *seriesTimestamps) accept(series string, timestamp time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.last[series]; ok && timestamp.Before(last) {
+		t.outOfOrder++
+		return false
+	}
+	t.last[series] = timestamp
+	return true
+}
+
+// expire forgets the series last exported before the start of the query window. No samples
+// that old can be fetched for them any more.
+func (t *seriesTimestamps) expire(windowStart time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for series, last := range t.last {
+		if last.Before(windowStart) {
+			delete(t.last, series)
+		}
+	}
+}
+
+func (t *seriesTimestamps) outOfOrderCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.outOfOrder
+}
+
+// timestampedMetric sets the timestamp of a metric, which the vendored client has no support for.
+type timestampedMetric struct {
+	prometheus.Metric
+	timestamp time.Time
+}
+
+func (m timestampedMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	out.TimestampMs = proto.Int64(m.timestamp.UnixNano() / int64(time.Millisecond))
+	return nil
+}
+
+func sampleToMetric(sample *meters.OldSample, labels []string, metric ceilometerMetric) prometheus.Metric {
+	var valueType prometheus.ValueType
+	sampleType := sample.Type
+	if sampleType == "" {
+		sampleType = metric.sampleType
+	}
+	switch sampleType {
+	case "", "gauge":
+		valueType = prometheus.GaugeValue
+	case "cumulative":
+		valueType = prometheus.CounterValue
+
+	default:
+		log.Debugf("Unknown sample type %v in query for %v", sample.Type, sample.Name)
+		valueType = prometheus.UntypedValue
+	}
+
+	if metric.valueType != nil {
+		valueType = *metric.valueType
+	}
+
+	value := sample.Volume * metric.scale
+
+	return prometheus.MustNewConstMetric(metric.desc, valueType, value, labels...)
+}
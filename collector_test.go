@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/rackspace/gophercloud"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newSampleServer serves the given number of samples of a meter, newest first, one second
+// apart and every second one sharing its timestamp with the previous, filtered and limited as
+// by Ceilometer.
+func newSampleServer(t *testing.T, count int, requests *int) (*httptest.Server, *gophercloud.ServiceClient) {
+	newest := time.Now().UTC().Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		query := r.URL.Query()
+		bound, err := time.Parse(timestampFormat, query.Get("q.value"))
+		if err != nil {
+			t.Errorf("invalid timestamp in query %q: %v", r.URL.RawQuery, err)
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+
+		page := []map[string]interface{}{}
+		for i := 0; i < count && len(page) < limit; i++ {
+			timestamp := newest.Add(-time.Duration(i/2) * time.Second)
+			if query.Get("q.op") == "gt" && !timestamp.After(bound) || query.Get("q.op") == "le" && timestamp.After(bound) {
+				continue
+			}
+			page = append(page, map[string]interface{}{
+				"counter_name":      "cpu",
+				"counter_type":      "cumulative",
+				"counter_volume":    float64(i),
+				"message_id":        fmt.Sprintf("message-%d", i),
+				"resource_id":       fmt.Sprintf("resource-%d", i),
+				"resource_metadata": map[string]interface{}{},
+				"timestamp":         timestamp.Format(timestampFormat),
+				"recorded_at":       timestamp.Format(timestampFormat),
+			})
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+	return server, client
+}
+
+func TestFetchSamplesPaginates(t *testing.T) {
+	var requests int
+	server, client := newSampleServer(t, 95, &requests)
+	defer server.Close()
+
+	samples, truncated, err := fetchSamples(client, "cpu", MeterConfig{MaxResults: 10, MaxSamples: 1000, MaxMetricAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Error("expected complete result")
+	}
+	if len(samples) != 95 {
+		t.Errorf("expected 95 samples, got %d", len(samples))
+	}
+	seen := make(map[string]bool)
+	for _, sample := range samples {
+		if seen[sample.MessageId] {
+			t.Errorf("duplicate sample %s", sample.MessageId)
+		}
+		seen[sample.MessageId] = true
+	}
+	if requests < 10 {
+		t.Errorf("expected at least 10 requests, got %d", requests)
+	}
+}
+
+func TestFetchSamplesBudget(t *testing.T) {
+	var requests int
+	server, client := newSampleServer(t, 95, &requests)
+	defer server.Close()
+
+	samples, truncated, err := fetchSamples(client, "cpu", MeterConfig{MaxResults: 10, MaxSamples: 25, MaxMetricAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("expected result to be truncated")
+	}
+	if len(samples) != 25 {
+		t.Errorf("expected 25 samples, got %d", len(samples))
+	}
+}
+
+func TestFetchSamplesWindow(t *testing.T) {
+	var requests int
+	server, client := newSampleServer(t, 95, &requests)
+	defer server.Close()
+
+	// Samples are spread over 47 seconds, so only some are within the window
+	samples, truncated, err := fetchSamples(client, "cpu", MeterConfig{MaxResults: 10, MaxSamples: 1000, MaxMetricAge: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Error("expected complete result")
+	}
+	for _, sample := range samples {
+		if time.Since(sample.Timestamp) > 12*time.Second {
+			t.Errorf("sample %s at %v is outside the window", sample.MessageId, sample.Timestamp)
+		}
+	}
+}
+
+func TestQuerySamplesFilters(t *testing.T) {
+	var request *http.Request
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+	bound := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	settings := MeterConfig{MaxResults: 10, Filters: []FilterConfig{
+		{Field: "project_id", Value: "p1"},
+		{Field: "metadata.status", Op: "ne", Value: "ERROR"},
+	}}
+	if _, err := querySamples(client, "cpu", settings, "gt", bound); err != nil {
+		t.Fatal(err)
+	}
+	query := request.URL.Query()
+	if request.Method != "GET" || request.URL.Path != "/v2/meters/cpu" {
+		t.Errorf("expected simple query, got %s %s", request.Method, request.URL.Path)
+	}
+	for param, expected := range map[string][]string{
+		"q.field": {"timestamp", "project_id", "metadata.status"},
+		"q.op":    {"gt", "eq", "ne"},
+		"q.value": {"2020-01-02T03:04:05", "p1", "ERROR"},
+	} {
+		if fmt.Sprint(query[param]) != fmt.Sprint(expected) {
+			t.Errorf("expected %s %v, got %v", param, expected, query[param])
+		}
+	}
+
+	settings.Filters = append(settings.Filters, FilterConfig{Field: "user_id", Op: "in", Values: []string{"u1", "u2"}})
+	if _, err := querySamples(client, "cpu", settings, "le", bound); err != nil {
+		t.Fatal(err)
+	}
+	if request.Method != "POST" || request.URL.Path != "/v2/query/samples" {
+		t.Errorf("expected complex query, got %s %s", request.Method, request.URL.Path)
+	}
+	expected := `{"and":[{"=":{"counter_name":"cpu"}},{"<=":{"timestamp":"2020-01-02T03:04:05"}},{"=":{"project_id":"p1"}},{"!=":{"resource_metadata.status":"ERROR"}},{"in":{"user_id":["u1","u2"]}}]}`
+	if body["filter"] != expected {
+		t.Errorf("expected filter %s, got %v", expected, body["filter"])
+	}
+	if body["orderby"] != `[{"timestamp":"desc"}]` || body["limit"] != float64(10) {
+		t.Errorf("unexpected orderby or limit in %v", body)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	definition := MeterDefinition{
+		Metric: "test",
+		Labels: []LabelDefinition{
+			{Name: "resource", From: "resource_id"},
+			{Name: "device", From: "metadata.device"},
+		},
+	}
+	base := time.Now()
+	samples := []meters.OldSample{
+		{ResourceId: "a", ResourceMetadata: map[string]interface{}{"device": "vda"}, Timestamp: base, Volume: 1},
+		{ResourceId: "a", ResourceMetadata: map[string]interface{}{"device": "vdb"}, Timestamp: base, Volume: 2},
+		{ResourceId: "a", ResourceMetadata: map[string]interface{}{"device": "vda"}, Timestamp: base.Add(time.Minute), Volume: 3},
+		{ResourceId: "a", ResourceMetadata: map[string]interface{}{"device": "vdb"}, Timestamp: base.Add(-time.Minute), Volume: 4},
+	}
+
+	series := deduplicate(context.Background(), samples, definition.build(nil, nil))
+	if len(series) != 2 {
+		t.Fatalf("expected a series per device, got %d", len(series))
+	}
+	for i, expected := range []float64{3, 2} {
+		if volume := series[i].sample.Volume; volume != expected {
+			t.Errorf("expected newest sample of series %v with volume %v, got %v", series[i].labels, expected, volume)
+		}
+	}
+
+	definition.Identity = []string{"resource"}
+	series = deduplicate(context.Background(), samples, definition.build(nil, nil))
+	if len(series) != 1 || series[0].sample.Volume != 3 {
+		t.Errorf("expected only the newest sample of the resource, got %v", series)
+	}
+}
+
+func TestSeriesTimestamps(t *testing.T) {
+	timestamps := newSeriesTimestamps()
+	base := time.Now()
+
+	if !timestamps.accept("a", base) || !timestamps.accept("a", base) || !timestamps.accept("a", base.Add(time.Minute)) {
+		t.Error("expected samples at the same or later times to be accepted")
+	}
+	if timestamps.accept("a", base) {
+		t.Error("expected an older sample to be rejected")
+	}
+	if !timestamps.accept("b", base) {
+		t.Error("expected series to be tracked separately")
+	}
+	if count := timestamps.outOfOrderCount(); count != 1 {
+		t.Errorf("expected 1 out of order sample, got %d", count)
+	}
+
+	timestamps.expire(base.Add(time.Second))
+	if !timestamps.accept("b", base.Add(-time.Minute)) {
+		t.Error("expected an expired series to be forgotten")
+	}
+	if timestamps.accept("a", base) {
+		t.Error("expected a series within the window to be kept")
+	}
+}
+
+// Cumulative meters such as cpu reach values beyond the precision of float32, and must be
+// exported exactly for rate() to work.
+func TestLargeValuesArePrecise(t *testing.T) {
+	const volume = 1234567890123457
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC().Format(timestampFormat)
+		if r.URL.Path == "/v2/meters/cpu/statistics" {
+			fmt.Fprintf(w, `[{"avg": %d, "min": %d, "max": %d, "sum": %d, "count": 1, "groupby": {"resource_id": "a"}}]`, volume, volume, volume, volume)
+			return
+		}
+		fmt.Fprintf(w, `[{"counter_name": "cpu", "counter_type": "cumulative", "counter_volume": %d, "resource_id": "a", "message_id": "m", "timestamp": %q}]`, volume, now)
+	}))
+	defer server.Close()
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+
+	samples, _, err := fetchSamples(client, "cpu", MeterConfig{MaxResults: 10, MaxSamples: 10, MaxMetricAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(samples))
+	}
+	definition := MeterDefinition{Metric: "cpu", Labels: []LabelDefinition{{Name: "resource", From: "resource_id"}}}
+	metric := definition.build(nil, nil)
+	var out dto.Metric
+	if err := sampleToMetric(&samples[0], metric.extractLabels(context.Background(), &samples[0]), metric).Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if value := out.GetCounter().GetValue(); value != volume {
+		t.Errorf("expected %d, got %f", volume, value)
+	}
+
+	statistics, err := meters.MeterStatistics(client, "cpu", meters.MeterStatisticsOpts{}).Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statistic := range []string{"avg", "min", "max", "sum"} {
+		if value := statisticValue(&statistics[0], statistic, 1); value != volume {
+			t.Errorf("expected %s of %d, got %f", statistic, volume, value)
+		}
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	defer close(release)
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+
+	metric := MeterDefinition{Metric: "cpu"}.build(nil, nil)
+	metric.settings = MeterConfig{MaxResults: 10, MaxSamples: 10, MaxMetricAge: time.Hour, Timeout: 50 * time.Millisecond}
+	ch := make(chan prometheus.Metric, 10)
+	result := make(chan scrapeStats, 1)
+
+	start := time.Now()
+	scrape(context.Background(), "cpu", metric, client, ch, result)
+	stats := <-result
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the meter timeout to stop the scrape, took %v", elapsed)
+	}
+	if stats.success || !stats.timedOut {
+		t.Errorf("expected the scrape to time out, got %+v", stats)
+	}
+
+	// The deadline of the whole scrape applies as well
+	metric.settings.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	scrape(ctx, "cpu", metric, client, ch, result)
+	if stats := <-result; !stats.timedOut {
+		t.Errorf("expected the scrape to time out, got %+v", stats)
+	}
+
+	// The deadline is set on copies, leaving the client shared by all scrapes as it was
+	if client.ProviderClient.HTTPClient.Transport != nil {
+		t.Errorf("expected the shared client not to be modified")
+	}
+}
+
+func TestCollectDoesNotLockCloud(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-release
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.EnabledMetrics = []string{"cpu"}
+	config.definitions = map[string]MeterDefinition{"cpu": {Metric: "cpu"}}
+	cloud := &openstackCloud{
+		config:    config,
+		connected: true,
+		session:   &keystoneSession{},
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	collector := NewCeilometerCollector(cloud, config.MetricSelection)
+	ch := make(chan prometheus.Metric, 100)
+	done := make(chan struct{})
+	go func() {
+		collector.Collect(ch)
+		close(done)
+	}()
+
+	// A reconnect is not held up by the scrape in flight
+	<-requested
+	locked := make(chan struct{})
+	go func() {
+		cloud.mu.Lock()
+		cloud.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("expected the cloud not to be locked during the scrape")
+	}
+	close(release)
+	<-done
+}
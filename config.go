@@ -0,0 +1,945 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+	"github.com/ryanuber/go-glob"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the exporter. It is read from the file given by -config.file,
+// and settings given as flags or OS_* environment variables take precedence over the file.
+//
+// To scrape several clouds or regions, each is listed under Clouds. The entries inherit all
+// settings from the top level, and may override any of them.
+type Config struct {
+	Name      string            `yaml:"name"`
+	Cloud     string            `yaml:"cloud"`
+	Auth      AuthConfig        `yaml:"auth"`
+	Region    string            `yaml:"region"`
+	Interface string            `yaml:"interface"`
+	Endpoints map[string]string `yaml:"endpoints"`
+	CACert    string            `yaml:"cacert"`
+	Insecure  bool              `yaml:"insecure"`
+
+	MeterDefinitions string `yaml:"meter_definitions"`
+
+	// Backend is the service meters are read from: ceilometer, the Ceilometer v2 API, or
+	// gnocchi, which replaces it in newer releases
+	Backend string        `yaml:"backend"`
+	Gnocchi GnocchiConfig `yaml:"gnocchi"`
+
+	MaxResults      int           `yaml:"max_results"`
+	MaxSamples      int           `yaml:"max_samples"`
+	MaxMetricAge    time.Duration `yaml:"max_metric_age"`
+	MetricSelection `yaml:",inline"`
+	Meters          map[string]MeterConfig `yaml:"meters"`
+	Lookup          LookupConfig           `yaml:"lookup"`
+	Events          EventsConfig           `yaml:"events"`
+	Resources       ResourcesConfig        `yaml:"resources"`
+	Discovery       DiscoveryConfig        `yaml:"discovery"`
+
+	// SampleTimestamps exports metrics with the timestamps of their samples, rather than
+	// leaving Prometheus to use the scrape time
+	SampleTimestamps bool `yaml:"sample_timestamps"`
+
+	// ScrapeTimeout limits the time taken by a scrape, if Prometheus does not announce a shorter
+	// timeout. ScrapeTimeoutOffset is subtracted from the timeout announced by Prometheus, to
+	// leave time for sending the response. Both only apply at the top level.
+	ScrapeTimeout       time.Duration `yaml:"scrape_timeout"`
+	ScrapeTimeoutOffset time.Duration `yaml:"scrape_timeout_offset"`
+
+	// PollInterval, if set, scrapes meters in the background at this interval rather than on
+	// each scrape by Prometheus, which is served the results of the latest poll. Each poll
+	// starts a random duration of up to PollJitter into its interval, to spread the requests
+	// over time.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	PollJitter   time.Duration `yaml:"poll_jitter"`
+
+	Clouds  []Config                   `yaml:"clouds"`
+	Modules map[string]MetricSelection `yaml:"modules"`
+
+	filename    string
+	root        *yaml.Node
+	targets     []*Config
+	definitions map[string]MeterDefinition
+	// appliedCloud is the clouds.yaml entry whose settings were applied, if any
+	appliedCloud *cloudConfig
+	// commonLabels are those of the meter definitions, which are added to discovered meters
+	commonLabels []LabelDefinition
+}
+
+// AuthConfig holds Keystone credentials. Type selects the authentication method; if not given,
+// it is inferred from the credentials present. DomainID and DomainName apply to both the user
+// and the project, unless more specific settings are given.
+type AuthConfig struct {
+	Type              string `yaml:"type"`
+	AuthURL           string `yaml:"auth_url"`
+	Username          string `yaml:"username"`
+	UserID            string `yaml:"user_id"`
+	Password          string `yaml:"password"`
+	ProjectID         string `yaml:"project_id"`
+	ProjectName       string `yaml:"project_name"`
+	DomainID          string `yaml:"domain_id"`
+	DomainName        string `yaml:"domain_name"`
+	UserDomainID      string `yaml:"user_domain_id"`
+	UserDomainName    string `yaml:"user_domain_name"`
+	ProjectDomainID   string `yaml:"project_domain_id"`
+	ProjectDomainName string `yaml:"project_domain_name"`
+	Token             string `yaml:"token"`
+	TrustID           string `yaml:"trust_id"`
+
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+
+	// Endpoint is the endpoint of the backend, used with a pre-issued token
+	Endpoint string `yaml:"endpoint"`
+}
+
+// MetricSelection chooses metrics with globs. A metric is used if it matches any of the
+// enabled globs and none of the disabled globs.
+type MetricSelection struct {
+	EnabledMetrics  []string `yaml:"enabled_metrics"`
+	DisabledMetrics []string `yaml:"disabled_metrics"`
+}
+
+// MeterConfig overrides the global query settings for a single meter. MaxResults is the page
+// size of each request, and MaxSamples the total number of samples fetched in one scrape.
+type MeterConfig struct {
+	MaxResults   int            `yaml:"max_results"`
+	MaxSamples   int            `yaml:"max_samples"`
+	MaxMetricAge time.Duration  `yaml:"max_metric_age"`
+	Filters      []FilterConfig `yaml:"filters"`
+	// SampleTimestamps overrides the global setting if given
+	SampleTimestamps *bool `yaml:"sample_timestamps"`
+	// Timeout limits the time taken to scrape the meter, within that of the whole scrape
+	Timeout time.Duration `yaml:"timeout"`
+	// PollInterval overrides the global setting if given, and polls the meter in the
+	// background even if other meters are scraped on request
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Aggregation and Granularity override the global Gnocchi settings if given
+	Aggregation string        `yaml:"aggregation"`
+	Granularity time.Duration `yaml:"granularity"`
+}
+
+// GnocchiConfig selects the measures read from Gnocchi. Aggregation is the aggregation method
+// of the archive policy, such as mean or max, and Granularity one of its granularities.
+type GnocchiConfig struct {
+	Aggregation string        `yaml:"aggregation"`
+	Granularity time.Duration `yaml:"granularity"`
+}
+
+// FilterConfig restricts the samples of a meter to those where Field compares to Value with
+// Op, which defaults to eq. The in operator matches any of Values instead.
+type FilterConfig struct {
+	Field  string   `yaml:"field"`
+	Op     string   `yaml:"op"`
+	Value  string   `yaml:"value"`
+	Values []string `yaml:"values"`
+}
+
+// LookupConfig controls the caches used to resolve instance and pool ids to names.
+type LookupConfig struct {
+	// RefreshInterval is how often the caches are reloaded from the compute and network APIs.
+	// Zero disables the background refresh.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	TTL             time.Duration `yaml:"ttl"`
+	NegativeTTL     time.Duration `yaml:"negative_ttl"`
+	MaxEntries      int           `yaml:"max_entries"`
+}
+
+// EventsConfig selects the events that are counted, and how.
+type EventsConfig struct {
+	// EventTypes are globs of the event types counted
+	EventTypes []string `yaml:"event_types"`
+	// Traits are the traits of the events exported as labels of the counts
+	Traits []string `yaml:"traits"`
+	// StateDir is where the counts are saved, along with the time of the last event counted,
+	// so that counting resumes after a restart. Without it, counting starts over.
+	StateDir string `yaml:"state_dir"`
+	// Lateness is how long before the newest event counted the events are read again, to count
+	// those that reach the API late. Events arriving later than that are not counted.
+	Lateness time.Duration `yaml:"lateness"`
+}
+
+// ResourcesConfig controls the inventory of resources.
+type ResourcesConfig struct {
+	// Labels are added to the info series of each resource, and are taken from its fields like
+	// the labels of meters
+	Labels []LabelDefinition `yaml:"labels"`
+	// Types are the meters giving the type of a resource when it has samples of them, in order
+	// of precedence
+	Types []string `yaml:"types"`
+}
+
+// DiscoveryConfig controls the discovery of the meters available in a cloud.
+type DiscoveryConfig struct {
+	// Enabled lists the meters of the cloud, exporting those without a definition under a
+	// generic name, and reports which defined meters are not available
+	Enabled bool `yaml:"enabled"`
+	// RefreshInterval is how often the list of meters is refreshed
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// Timeout limits the time taken to list the meters
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxMeters limits the number of meters listed
+	MaxMeters int `yaml:"max_meters"`
+}
+
+// Labels of the info series of resources that cannot be defined in ResourcesConfig.Labels
+var resourceInfoLabels = []string{"resource_id", "project_id", "user_id", "source", "type", "cloud", "region"}
+
+var yamlLinePrefix = regexp.MustCompile(`^line [0-9]+: `)
+
+var filterFieldPattern = regexp.MustCompile(`^(resource_id|project_id|user_id|source|metadata\.[A-Za-z0-9_.:-]+)$`)
+
+const (
+	backendCeilometer = "ceilometer"
+	backendGnocchi    = "gnocchi"
+)
+
+var knownServiceTypes = map[string]bool{
+	telemetryServiceType: true,
+	metricServiceType:    true,
+	alarmingServiceType:  true,
+	eventServiceType:     true,
+	computeServiceType:   true,
+	networkServiceType:   true,
+}
+
+var validInterfaces = map[string]gophercloud.Availability{
+	"":         gophercloud.AvailabilityPublic,
+	"public":   gophercloud.AvailabilityPublic,
+	"internal": gophercloud.AvailabilityInternal,
+	"admin":    gophercloud.AvailabilityAdmin,
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		MaxResults:   100,
+		MaxSamples:   10000,
+		MaxMetricAge: 5 * time.Minute,
+		Backend:      backendCeilometer,
+		Gnocchi: GnocchiConfig{
+			Aggregation: "mean",
+			Granularity: 5 * time.Minute,
+		},
+		Lookup: LookupConfig{
+			RefreshInterval: 10 * time.Minute,
+			TTL:             time.Hour,
+			NegativeTTL:     5 * time.Minute,
+			MaxEntries:      10000,
+		},
+		Events: EventsConfig{
+			EventTypes: []string{"*"},
+			Lateness:   5 * time.Minute,
+		},
+		Resources: ResourcesConfig{
+			Types: []string{"instance", "volume", "image", "network", "subnet", "port", "router", "ip.floating"},
+		},
+		Discovery: DiscoveryConfig{
+			RefreshInterval: 10 * time.Minute,
+			Timeout:         time.Minute,
+			MaxMeters:       1000,
+		},
+		MetricSelection: MetricSelection{
+			EnabledMetrics:  []string{defaultEnabledMetrics},
+			DisabledMetrics: []string{},
+		},
+		ScrapeTimeoutOffset: 500 * time.Millisecond,
+	}
+}
+
+// loadConfig reads the configuration file, if any, and applies overrides from clouds.yaml, the
+// environment and flags on top of it, in that order.
+func loadConfig(filename string) (*Config, error) {
+	config := defaultConfig()
+	if filename != "" {
+		if err := config.readFile(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if cloudName := os.Getenv("OS_CLOUD"); cloudName != "" {
+		config.Cloud = cloudName
+	}
+	if *osCloud != "" {
+		config.Cloud = *osCloud
+	}
+	if config.Cloud != "" {
+		cloud, err := loadCloud(config.Cloud)
+		if err != nil {
+			return nil, err
+		}
+		config.applyCloud(cloud)
+	}
+
+	config.applyEnv()
+	config.applyFlags()
+
+	definitions, commonLabels, err := loadMeterDefinitions(config.MeterDefinitions)
+	if err != nil {
+		return nil, err
+	}
+	config.definitions = definitions
+	config.commonLabels = commonLabels
+
+	if err := config.resolveTargets(); err != nil {
+		return nil, err
+	}
+	for _, target := range config.targets {
+		if err := target.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// resolveTargets builds the configuration of each cloud to scrape. Without a clouds section,
+// the top level configuration is the only target.
+func (c *Config) resolveTargets() error {
+	cloudsNode := mappingValue(c.documentNode(), "clouds")
+	if cloudsNode == nil || len(cloudsNode.Content) == 0 {
+		if c.Name == "" {
+			c.Name = c.Cloud
+		}
+		if c.Name == "" {
+			c.Name = "default"
+		}
+		c.targets = []*Config{c}
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for _, node := range cloudsNode.Content {
+		target := c.inherit()
+		target.root = node
+
+		// Settings from clouds.yaml go beneath those given explicitly in the entry. Those of the
+		// cloud of the top level are not inherited by entries for other clouds.
+		if err := decodeStrict(node, target); err != nil {
+			return target.errorAt(nil, "%v", err)
+		}
+		if target.Cloud != c.Cloud && target.Cloud != "" {
+			cloud, err := loadCloud(target.Cloud)
+			if err != nil {
+				return target.errorAt([]string{"cloud"}, "%v", err)
+			}
+			if target.appliedCloud != nil {
+				target.removeCloud(target.appliedCloud)
+			}
+			target.applyCloud(cloud)
+			if err := decodeStrict(node, target); err != nil {
+				return target.errorAt(nil, "%v", err)
+			}
+		}
+
+		if target.Name == "" {
+			target.Name = target.Cloud
+		}
+		if target.Name == "" {
+			return target.errorAt(nil, "name must be set for each cloud")
+		}
+		if len(target.Clouds) > 0 {
+			return target.errorAt([]string{"clouds"}, "clouds cannot be nested")
+		}
+		if len(target.Modules) > 0 {
+			return target.errorAt([]string{"modules"}, "modules must be defined at the top level")
+		}
+		if target.MeterDefinitions != c.MeterDefinitions {
+			return target.errorAt([]string{"meter_definitions"}, "meter_definitions must be set at the top level")
+		}
+		if names[target.Name] {
+			return target.errorAt([]string{"name"}, "duplicate cloud name %q", target.Name)
+		}
+		names[target.Name] = true
+		c.targets = append(c.targets, target)
+	}
+	return nil
+}
+
+// decodeStrict decodes node into out, rejecting unknown fields as readFile does. yaml.v3 only
+// checks them when decoding a document, so the node is encoded again for this, and the line
+// numbers of the errors, which are those of the new document, are left out.
+func decodeStrict(node *yaml.Node, out interface{}) error {
+	content, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(out)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages := make([]string, len(typeErr.Errors))
+		for i, message := range typeErr.Errors {
+			messages[i] = yamlLinePrefix.ReplaceAllString(message, "")
+		}
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return err
+}
+
+// inherit returns a copy of the configuration, to be used as the base of a clouds entry.
+func (c *Config) inherit() *Config {
+	inherited := *c
+	inherited.Name = ""
+	inherited.Clouds = nil
+	inherited.Modules = nil
+	inherited.targets = nil
+	inherited.Endpoints = make(map[string]string, len(c.Endpoints))
+	for serviceType, url := range c.Endpoints {
+		inherited.Endpoints[serviceType] = url
+	}
+	inherited.Meters = make(map[string]MeterConfig, len(c.Meters))
+	for name, meter := range c.Meters {
+		meter.Filters = append([]FilterConfig(nil), meter.Filters...)
+		inherited.Meters[name] = meter
+	}
+	return &inherited
+}
+
+func (s MetricSelection) shouldUseMetric(metric string) bool {
+	for _, enabled := range s.EnabledMetrics {
+		if glob.Glob(enabled, metric) {
+			for _, disabled := range s.DisabledMetrics {
+				if glob.Glob(disabled, metric) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) readFile(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(content, root); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	c.filename = filename
+	c.root = root
+	return nil
+}
+
+// applyFlags overrides the file with any flags that were explicitly given on the command line.
+func (c *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "meter-definitions":
+			c.MeterDefinitions = *meterDefinitions
+		case "backend":
+			c.Backend = *backend
+		case "max-results":
+			c.MaxResults = *maxResults
+		case "max-samples":
+			c.MaxSamples = *maxSamples
+		case "max-metric-age":
+			c.MaxMetricAge = *maxMetricAge
+		case "sample-timestamps":
+			c.SampleTimestamps = *sampleTimestamps
+		case "scrape-timeout":
+			c.ScrapeTimeout = *scrapeTimeout
+		case "scrape-timeout-offset":
+			c.ScrapeTimeoutOffset = *scrapeTimeoutOffset
+		case "poll-interval":
+			c.PollInterval = *pollInterval
+		case "poll-jitter":
+			c.PollJitter = *pollJitter
+		case "enabled-metrics":
+			c.EnabledMetrics = strings.Split(*rawEnabledMetrics, ",")
+		case "disabled-metrics":
+			c.DisabledMetrics = strings.Split(*rawDisabledMetrics, ",")
+		case "lookup-refresh-interval":
+			c.Lookup.RefreshInterval = *lookupRefreshInterval
+		case "lookup-ttl":
+			c.Lookup.TTL = *lookupTTL
+		case "lookup-negative-ttl":
+			c.Lookup.NegativeTTL = *lookupNegativeTTL
+		case "lookup-max-entries":
+			c.Lookup.MaxEntries = *lookupMaxEntries
+		case "os-region":
+			c.Region = *osRegion
+		case "os-interface":
+			c.Interface = normalizeInterface(*osInterface)
+		case "endpoint-overrides":
+			if c.Endpoints == nil {
+				c.Endpoints = make(map[string]string)
+			}
+			for _, override := range strings.Split(*rawEndpoints, ",") {
+				parts := strings.SplitN(override, "=", 2)
+				if len(parts) == 2 {
+					c.Endpoints[parts[0]] = parts[1]
+				} else {
+					// Caught by validate
+					c.Endpoints[override] = ""
+				}
+			}
+		}
+	})
+}
+
+// applyEnv overrides the credentials in the file with any OS_* variables that are set.
+func (c *Config) applyEnv() {
+	// Later entries win, so that the newer OS_PROJECT_* names take precedence over OS_TENANT_*
+	for _, setting := range []struct {
+		variable string
+		field    *string
+	}{
+		{"OS_AUTH_URL", &c.Auth.AuthURL},
+		{"OS_USERNAME", &c.Auth.Username},
+		{"OS_USERID", &c.Auth.UserID},
+		{"OS_USER_ID", &c.Auth.UserID},
+		{"OS_PASSWORD", &c.Auth.Password},
+		{"OS_TENANT_ID", &c.Auth.ProjectID},
+		{"OS_PROJECT_ID", &c.Auth.ProjectID},
+		{"OS_TENANT_NAME", &c.Auth.ProjectName},
+		{"OS_PROJECT_NAME", &c.Auth.ProjectName},
+		{"OS_DOMAIN_ID", &c.Auth.DomainID},
+		{"OS_DOMAIN_NAME", &c.Auth.DomainName},
+		{"OS_USER_DOMAIN_ID", &c.Auth.UserDomainID},
+		{"OS_USER_DOMAIN_NAME", &c.Auth.UserDomainName},
+		{"OS_PROJECT_DOMAIN_ID", &c.Auth.ProjectDomainID},
+		{"OS_PROJECT_DOMAIN_NAME", &c.Auth.ProjectDomainName},
+		{"OS_TOKEN", &c.Auth.Token},
+		{"OS_TRUST_ID", &c.Auth.TrustID},
+		{"OS_AUTH_TYPE", &c.Auth.Type},
+		{"OS_APPLICATION_CREDENTIAL_ID", &c.Auth.ApplicationCredentialID},
+		{"OS_APPLICATION_CREDENTIAL_NAME", &c.Auth.ApplicationCredentialName},
+		{"OS_APPLICATION_CREDENTIAL_SECRET", &c.Auth.ApplicationCredentialSecret},
+		{"OS_ENDPOINT", &c.Auth.Endpoint},
+		{"OS_REGION_NAME", &c.Region},
+		{"OS_CACERT", &c.CACert},
+	} {
+		if value := os.Getenv(setting.variable); value != "" {
+			*setting.field = value
+		}
+	}
+	for _, variable := range []string{"OS_ENDPOINT_TYPE", "OS_INTERFACE"} {
+		if value := os.Getenv(variable); value != "" {
+			c.Interface = normalizeInterface(value)
+		}
+	}
+}
+
+// normalizeInterface accepts the legacy endpoint type names, such as publicURL.
+func normalizeInterface(value string) string {
+	return strings.TrimSuffix(value, "URL")
+}
+
+func (c *Config) validate() error {
+	if _, ok := validInterfaces[c.Interface]; !ok {
+		return c.errorAt([]string{"interface"}, "invalid interface %q, must be one of public, internal or admin", c.Interface)
+	}
+	for serviceType, endpoint := range c.Endpoints {
+		if !knownServiceTypes[serviceType] {
+			return c.errorAt([]string{"endpoints", serviceType}, "unknown service type %q, must be one of %s, %s, %s, %s, %s or %s", serviceType, telemetryServiceType, metricServiceType, alarmingServiceType, eventServiceType, computeServiceType, networkServiceType)
+		}
+		if parsed, err := url.Parse(endpoint); err != nil || !parsed.IsAbs() {
+			return c.errorAt([]string{"endpoints", serviceType}, "invalid URL %q for %s endpoint", endpoint, serviceType)
+		}
+	}
+	if c.Backend != backendCeilometer && c.Backend != backendGnocchi {
+		return c.errorAt([]string{"backend"}, "invalid backend %q, must be %s or %s", c.Backend, backendCeilometer, backendGnocchi)
+	}
+	if c.Gnocchi.Aggregation == "" {
+		return c.errorAt([]string{"gnocchi", "aggregation"}, "aggregation must be set")
+	}
+	if c.Gnocchi.Granularity < 0 {
+		return c.errorAt([]string{"gnocchi", "granularity"}, "granularity must not be negative")
+	}
+	if c.MaxResults <= 0 {
+		return c.errorAt([]string{"max_results"}, "max_results must be positive")
+	}
+	if c.MaxSamples <= 0 {
+		return c.errorAt([]string{"max_samples"}, "max_samples must be positive")
+	}
+	if c.ScrapeTimeout < 0 {
+		return c.errorAt([]string{"scrape_timeout"}, "scrape_timeout must not be negative")
+	}
+	if c.ScrapeTimeoutOffset < 0 {
+		return c.errorAt([]string{"scrape_timeout_offset"}, "scrape_timeout_offset must not be negative")
+	}
+	if c.PollInterval < 0 {
+		return c.errorAt([]string{"poll_interval"}, "poll_interval must not be negative")
+	}
+	if c.PollJitter < 0 {
+		return c.errorAt([]string{"poll_jitter"}, "poll_jitter must not be negative")
+	}
+	if c.Discovery.RefreshInterval <= 0 {
+		return c.errorAt([]string{"discovery", "refresh_interval"}, "refresh_interval must be positive")
+	}
+	if c.Discovery.Timeout <= 0 {
+		return c.errorAt([]string{"discovery", "timeout"}, "timeout must be positive")
+	}
+	if c.Discovery.MaxMeters <= 0 {
+		return c.errorAt([]string{"discovery", "max_meters"}, "max_meters must be positive")
+	}
+	if c.Discovery.Enabled && c.Backend != backendCeilometer {
+		return c.errorAt([]string{"discovery", "enabled"}, "meters can only be discovered with the %s backend", backendCeilometer)
+	}
+	if c.Lookup.RefreshInterval < 0 {
+		return c.errorAt([]string{"lookup", "refresh_interval"}, "refresh_interval must not be negative")
+	}
+	if c.Lookup.TTL <= 0 {
+		return c.errorAt([]string{"lookup", "ttl"}, "ttl must be positive")
+	}
+	if c.Lookup.NegativeTTL <= 0 {
+		return c.errorAt([]string{"lookup", "negative_ttl"}, "negative_ttl must be positive")
+	}
+	if c.Lookup.MaxEntries <= 0 {
+		return c.errorAt([]string{"lookup", "max_entries"}, "max_entries must be positive")
+	}
+	if c.Events.Lateness < 0 {
+		return c.errorAt([]string{"events", "lateness"}, "lateness must not be negative")
+	}
+	traits := make(map[string]bool)
+	for _, trait := range c.Events.Traits {
+		if !validLabelName.MatchString(trait) || trait == "event_type" || trait == "cloud" || trait == "region" {
+			return c.errorAt([]string{"events", "traits"}, "invalid trait %q, must be a valid label name other than event_type, cloud or region", trait)
+		}
+		if traits[trait] {
+			return c.errorAt([]string{"events", "traits"}, "duplicate trait %q", trait)
+		}
+		traits[trait] = true
+	}
+	labelNames := make(map[string]bool)
+	for _, name := range resourceInfoLabels {
+		labelNames[name] = true
+	}
+	for _, label := range c.Resources.Labels {
+		if !validLabelName.MatchString(label.Name) || labelNames[label.Name] {
+			return c.errorAt([]string{"resources", "labels"}, "invalid, duplicate or reserved label name %q", label.Name)
+		}
+		labelNames[label.Name] = true
+		if err := label.validate(); err != nil {
+			return c.errorAt([]string{"resources", "labels"}, "label %q: %v", label.Name, err)
+		}
+	}
+	for name, meter := range c.Meters {
+		if _, ok := c.definitions[name]; !ok {
+			return c.errorAt([]string{"meters", name}, "unknown meter %q", name)
+		}
+		if meter.MaxResults < 0 {
+			return c.errorAt([]string{"meters", name, "max_results"}, "max_results must be positive")
+		}
+		if meter.MaxSamples < 0 {
+			return c.errorAt([]string{"meters", name, "max_samples"}, "max_samples must be positive")
+		}
+		if meter.Timeout < 0 {
+			return c.errorAt([]string{"meters", name, "timeout"}, "timeout must not be negative")
+		}
+		if meter.Granularity < 0 {
+			return c.errorAt([]string{"meters", name, "granularity"}, "granularity must not be negative")
+		}
+		if meter.PollInterval < 0 {
+			return c.errorAt([]string{"meters", name, "poll_interval"}, "poll_interval must not be negative")
+		}
+		if meter.SampleTimestamps != nil && *meter.SampleTimestamps && c.definitions[name].Mode == meterModeStatistics {
+			return c.errorAt([]string{"meters", name, "sample_timestamps"}, "sample_timestamps cannot be used for meters in statistics mode")
+		}
+		for i, filter := range meter.Filters {
+			if err := filter.validate(c.definitions[name]); err != nil {
+				return c.errorAt([]string{"meters", name, "filters"}, "filter %d: %v", i+1, err)
+			}
+			if c.Backend == backendGnocchi && filter.Field == "source" {
+				return c.errorAt([]string{"meters", name, "filters"}, "filter %d: Gnocchi resources have no source field", i+1)
+			}
+		}
+	}
+	// Polled results are dropped once older than max_metric_age, so they must be renewed sooner.
+	// Polls start up to poll_jitter into their interval, so they are renewed every interval plus
+	// jitter at worst.
+	names := make([]string, 0, len(c.definitions))
+	for name := range c.definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		meter := c.meterConfig(name)
+		if meter.PollInterval == 0 {
+			continue
+		}
+		path := []string{"poll_interval"}
+		if c.Meters[name].PollInterval != 0 {
+			path = []string{"meters", name, "poll_interval"}
+		}
+		if c.PollJitter >= meter.PollInterval {
+			return c.errorAt([]string{"poll_jitter"}, "poll_jitter must be shorter than the poll_interval of %s (%v)", name, meter.PollInterval)
+		}
+		if meter.PollInterval+c.PollJitter >= meter.MaxMetricAge {
+			return c.errorAt(path, "poll_interval of %s plus poll_jitter must be shorter than its max_metric_age (%v)", name, meter.MaxMetricAge)
+		}
+	}
+	return nil
+}
+
+func (f *FilterConfig) validate(definition MeterDefinition) error {
+	if !filterFieldPattern.MatchString(f.Field) {
+		return fmt.Errorf("invalid field %q, must be resource_id, project_id, user_id, source or metadata.<key>", f.Field)
+	}
+	switch f.op() {
+	case "in":
+		if len(f.Values) == 0 || f.Value != "" {
+			return fmt.Errorf("values, and not value, must be set with the in operator")
+		}
+		if definition.Mode == meterModeStatistics {
+			return fmt.Errorf("the in operator cannot be used for meters in statistics mode")
+		}
+	case "eq", "ne", "lt", "le", "gt", "ge":
+		if len(f.Values) > 0 {
+			return fmt.Errorf("values can only be used with the in operator")
+		}
+	default:
+		return fmt.Errorf("invalid op %q, must be one of eq, ne, lt, le, gt, ge or in", f.Op)
+	}
+	return nil
+}
+
+// op returns the comparison operator, defaulting to eq.
+func (f *FilterConfig) op() string {
+	if f.Op == "" {
+		return "eq"
+	}
+	return f.Op
+}
+
+// validateAuth checks that enough credentials are present to authenticate to each target. It
+// is separate from validate, as listing the available metrics does not require any credentials.
+func (c *Config) validateAuth() error {
+	for _, target := range c.targets {
+		if err := target.validateTargetAuth(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateTargetAuth() error {
+	path := []string{"auth"}
+	switch c.Auth.method() {
+	case authPassword:
+		if c.Auth.Password == "" {
+			return c.errorAt(path, "password (or OS_PASSWORD) must be set")
+		}
+		if c.Auth.Username == "" && c.Auth.UserID == "" {
+			return c.errorAt(path, "username or user_id (or OS_USERNAME/OS_USER_ID) must be set when using a password")
+		}
+	case authToken:
+		if c.Auth.Token == "" {
+			return c.errorAt(path, "token (or OS_TOKEN) must be set")
+		}
+	case authApplicationCredential:
+		if c.Auth.ApplicationCredentialSecret == "" {
+			return c.errorAt(path, "application_credential_secret (or OS_APPLICATION_CREDENTIAL_SECRET) must be set")
+		}
+		if c.Auth.ApplicationCredentialID == "" && c.Auth.ApplicationCredentialName == "" {
+			return c.errorAt(path, "application_credential_id or application_credential_name must be set")
+		}
+		if c.Auth.ApplicationCredentialID == "" && c.Auth.Username == "" && c.Auth.UserID == "" {
+			return c.errorAt(path, "username or user_id must be set when using an application credential name")
+		}
+		if c.Auth.TrustID != "" {
+			return c.errorAt(path, "application credentials cannot be used with a trust")
+		}
+	case authTokenEndpoint:
+		if c.Auth.Token == "" {
+			return c.errorAt(path, "token (or OS_TOKEN) must be set")
+		}
+		if c.Auth.Endpoint == "" && c.Endpoints[c.storageServiceType()] == "" {
+			return c.errorAt(path, "endpoint (or OS_ENDPOINT) must be set when using a pre-issued token")
+		}
+		return nil
+	default:
+		return c.errorAt([]string{"auth", "type"}, "unknown authentication type %q", c.Auth.Type)
+	}
+	if c.Auth.AuthURL == "" {
+		return c.errorAt(path, "auth_url (or OS_AUTH_URL) must be set")
+	}
+	return nil
+}
+
+// method returns the authentication method, inferring it from the credentials if not given.
+func (a *AuthConfig) method() string {
+	switch {
+	case a.Type != "":
+		return normalizeAuthType(a.Type)
+	case a.ApplicationCredentialSecret != "":
+		return authApplicationCredential
+	case a.Password == "" && a.Token != "":
+		return authToken
+	default:
+		return authPassword
+	}
+}
+
+// needsV3Extensions tells if the credentials can only be handled by authenticateV3, rather
+// than the vendored identity client.
+func (a *AuthConfig) needsV3Extensions() bool {
+	if a.method() == authApplicationCredential || a.TrustID != "" {
+		return true
+	}
+	userDomainID, userDomainName := a.userDomain()
+	projectDomainID, projectDomainName := a.projectDomain()
+	return userDomainID != projectDomainID || userDomainName != projectDomainName
+}
+
+func (a *AuthConfig) userDomain() (string, string) {
+	if a.UserDomainID != "" || a.UserDomainName != "" {
+		return a.UserDomainID, a.UserDomainName
+	}
+	return a.DomainID, a.DomainName
+}
+
+func (a *AuthConfig) projectDomain() (string, string) {
+	if a.ProjectDomainID != "" || a.ProjectDomainName != "" {
+		return a.ProjectDomainID, a.ProjectDomainName
+	}
+	return a.userDomain()
+}
+
+// errorAt formats a validation error, prefixed with the position in the configuration file of
+// the deepest element of path that is present there.
+func (c *Config) errorAt(path []string, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if c.root == nil {
+		return fmt.Errorf("invalid configuration: %s", msg)
+	}
+
+	node := c.documentNode()
+	line, column := node.Line, node.Column
+	for _, key := range path {
+		node = mappingValue(node, key)
+		if node == nil {
+			break
+		}
+		line, column = node.Line, node.Column
+	}
+	return fmt.Errorf("%s:%d:%d: %s", c.filename, line, column, msg)
+}
+
+// documentNode returns the top level node of the configuration.
+func (c *Config) documentNode() *yaml.Node {
+	node := c.root
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	return node
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func (c *Config) authOptions() gophercloud.AuthOptions {
+	domainID, domainName := c.Auth.userDomain()
+	return gophercloud.AuthOptions{
+		IdentityEndpoint: c.Auth.AuthURL,
+		Username:         c.Auth.Username,
+		UserID:           c.Auth.UserID,
+		Password:         c.Auth.Password,
+		TenantID:         c.Auth.ProjectID,
+		TenantName:       c.Auth.ProjectName,
+		DomainID:         domainID,
+		DomainName:       domainName,
+		TokenID:          c.Auth.Token,
+	}
+}
+
+// httpClient returns the client used for all requests, trusting CACert if given.
+func (c *Config) httpClient() (http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CACert != "" {
+		pem, err := ioutil.ReadFile(c.CACert)
+		if err != nil {
+			return http.Client{}, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return http.Client{}, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+	return http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// endpointOpts returns the options used to locate services in the catalog.
+func (c *Config) endpointOpts() gophercloud.EndpointOpts {
+	return gophercloud.EndpointOpts{
+		Region:       c.Region,
+		Availability: validInterfaces[c.Interface],
+	}
+}
+
+// meterConfig returns the query settings for a meter, falling back to the global settings.
+func (c *Config) meterConfig(name string) MeterConfig {
+	meter := c.Meters[name]
+	if meter.MaxResults == 0 {
+		meter.MaxResults = c.MaxResults
+	}
+	if meter.MaxSamples == 0 {
+		meter.MaxSamples = c.MaxSamples
+	}
+	if meter.MaxMetricAge == 0 {
+		meter.MaxMetricAge = c.MaxMetricAge
+	}
+	if meter.SampleTimestamps == nil {
+		meter.SampleTimestamps = &c.SampleTimestamps
+	}
+	if meter.PollInterval == 0 {
+		meter.PollInterval = c.PollInterval
+	}
+	if meter.Aggregation == "" {
+		meter.Aggregation = c.Gnocchi.Aggregation
+	}
+	if meter.Granularity == 0 {
+		meter.Granularity = c.Gnocchi.Granularity
+	}
+	return meter
+}
+
+// storageServiceType returns the type of the service meters are read from.
+func (c *Config) storageServiceType() string {
+	if c.Backend == backendGnocchi {
+		return metricServiceType
+	}
+	return telemetryServiceType
+}
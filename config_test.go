@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// readTestConfig reads content as a configuration file on top of the defaults.
+func readTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(content)
+	file.Close()
+
+	config := defaultConfig()
+	if err := config.readFile(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// setEnv sets environment variables for the duration of a test.
+func setEnv(t *testing.T, variables map[string]string) {
+	t.Helper()
+	for variable, value := range variables {
+		previous, ok := os.LookupEnv(variable)
+		os.Setenv(variable, value)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(variable, previous)
+			} else {
+				os.Unsetenv(variable)
+			}
+		})
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	config := readTestConfig(t, `
+region: R1
+max_results: 50
+max_metric_age: 5m
+endpoints:
+  metering: http://ceilometer/
+meters:
+  cpu:
+    max_samples: 10
+clouds:
+  - name: first
+  - name: second
+    region: R2
+    endpoints:
+      compute: http://nova/
+    meters:
+      cpu:
+        max_samples: 20
+`)
+	if err := config.resolveTargets(); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(config.targets))
+	}
+
+	first, second := config.targets[0], config.targets[1]
+	if first.Name != "first" || first.Region != "R1" || first.MaxResults != 50 || first.MaxMetricAge != 5*time.Minute || first.Meters["cpu"].MaxSamples != 10 {
+		t.Errorf("expected the first cloud to inherit the top level settings, got %+v", first)
+	}
+	if second.Name != "second" || second.Region != "R2" || second.MaxResults != 50 || second.Meters["cpu"].MaxSamples != 20 {
+		t.Errorf("expected the second cloud to override the top level settings, got %+v", second)
+	}
+	if second.Endpoints["metering"] != "http://ceilometer/" || second.Endpoints["compute"] != "http://nova/" {
+		t.Errorf("expected the endpoints of the second cloud to be merged, got %v", second.Endpoints)
+	}
+	if len(first.Endpoints) != 1 || len(config.Endpoints) != 1 || config.Meters["cpu"].MaxSamples != 10 {
+		t.Errorf("expected overrides not to leak into other clouds, got %v and %v", first.Endpoints, config.Meters)
+	}
+}
+
+func TestResolveTargetsWithoutClouds(t *testing.T) {
+	config := readTestConfig(t, "region: R1\n")
+	if err := config.resolveTargets(); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.targets) != 1 || config.targets[0] != config || config.Name != "default" {
+		t.Errorf("expected the top level to be the only target, got %+v", config.targets)
+	}
+
+	config = readTestConfig(t, "cloud: mycloud\n")
+	config.Cloud = "mycloud"
+	if err := config.resolveTargets(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "mycloud" {
+		t.Errorf("expected the target to be named after its cloud, got %q", config.Name)
+	}
+}
+
+func TestResolveTargetsErrors(t *testing.T) {
+	for _, test := range []struct {
+		content, err string
+	}{
+		{`
+clouds:
+  - region: R1
+`, ":3:5: name must be set for each cloud"},
+		{`
+clouds:
+  - name: a
+  - name: a
+`, ":4:11: duplicate cloud name \"a\""},
+		{`
+clouds:
+  - name: a
+    clouds:
+      - name: b
+`, ":5:7: clouds cannot be nested"},
+		{`
+meter_definitions: meters.yaml
+clouds:
+  - name: a
+    meter_definitions: other.yaml
+`, ":5:24: meter_definitions must be set at the top level"},
+		{`
+clouds:
+  - name: a
+    modules:
+      m: {}
+`, ":5:7: modules must be defined at the top level"},
+	} {
+		config := readTestConfig(t, test.content)
+		err := config.resolveTargets()
+		if err == nil || err.Error() != config.filename+test.err {
+			t.Errorf("expected error %q, got %v", config.filename+test.err, err)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	setEnv(t, map[string]string{
+		"OS_AUTH_URL":      "http://keystone/v3",
+		"OS_USERNAME":      "user",
+		"OS_TENANT_NAME":   "tenant",
+		"OS_PROJECT_NAME":  "project",
+		"OS_TENANT_ID":     "tenant-id",
+		"OS_USERID":        "legacy-user-id",
+		"OS_USER_ID":       "user-id",
+		"OS_REGION_NAME":   "R2",
+		"OS_ENDPOINT_TYPE": "publicURL",
+		"OS_INTERFACE":     "internalURL",
+		"OS_PASSWORD":      "",
+	})
+
+	config := readTestConfig(t, `
+region: R1
+interface: admin
+auth:
+  password: secret
+  username: file-user
+`)
+	config.applyEnv()
+	auth := config.Auth
+	if auth.AuthURL != "http://keystone/v3" || auth.Username != "user" || auth.ProjectName != "project" || auth.ProjectID != "tenant-id" || auth.UserID != "user-id" {
+		t.Errorf("unexpected credentials from the environment: %+v", auth)
+	}
+	if auth.Password != "secret" {
+		t.Errorf("expected an empty variable not to override the file, got %q", auth.Password)
+	}
+	if config.Region != "R2" || config.Interface != "internal" {
+		t.Errorf("expected region R2 and interface internal, got %q and %q", config.Region, config.Interface)
+	}
+}
+
+func TestErrorAt(t *testing.T) {
+	config := readTestConfig(t, `
+max_results: 10
+meters:
+  cpu:
+    max_samples: 5
+`)
+	for _, test := range []struct {
+		path     []string
+		position string
+	}{
+		{nil, ":2:1"},
+		{[]string{"max_results"}, ":2:14"},
+		{[]string{"meters", "cpu", "max_samples"}, ":5:18"},
+		// The deepest element present is used
+		{[]string{"meters", "memory", "max_samples"}, ":4:3"},
+		{[]string{"lookup", "ttl"}, ":2:1"},
+	} {
+		expected := config.filename + test.position + ": invalid value 1"
+		if err := config.errorAt(test.path, "invalid value %d", 1); err == nil || err.Error() != expected {
+			t.Errorf("expected %q for %v, got %v", expected, test.path, err)
+		}
+	}
+
+	// Without a file, there is no position to report
+	if err := defaultConfig().errorAt([]string{"max_results"}, "invalid"); err == nil || err.Error() != "invalid configuration: invalid" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestValidatePolling(t *testing.T) {
+	for _, test := range []struct {
+		content, err string
+	}{
+		{`
+poll_interval: 4m
+poll_jitter: 30s
+`, ""},
+		{`
+poll_interval: 4m
+poll_jitter: 2m
+`, ":2:16: poll_interval of cpu plus poll_jitter must be shorter than its max_metric_age (5m0s)"},
+		{`
+poll_interval: 1m
+poll_jitter: 1m
+`, ":3:14: poll_jitter must be shorter than the poll_interval of cpu (1m0s)"},
+		{`
+poll_jitter: 30s
+meters:
+  cpu:
+    poll_interval: 4m40s
+`, ":5:20: poll_interval of cpu plus poll_jitter must be shorter than its max_metric_age (5m0s)"},
+	} {
+		config := readTestConfig(t, test.content)
+		config.definitions = map[string]MeterDefinition{"cpu": {Metric: "cpu"}}
+		err := config.validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		} else if err == nil || err.Error() != config.filename+test.err {
+			t.Errorf("expected error %q, got %v", config.filename+test.err, err)
+		}
+	}
+}
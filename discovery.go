@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// meterDiscovery keeps the list of meters available in a cloud, refreshed in the background, and
+// the generic definitions of those that have no definition of their own.
+type meterDiscovery struct {
+	cloud    *openstackCloud
+	interval time.Duration
+
+	mu sync.RWMutex
+	// available and definitions are replaced on each refresh, and not modified afterwards
+	available       map[string]bool
+	definitions     map[string]MeterDefinition
+	refreshed       time.Time
+	refreshFailures int
+}
+
+var errNotConnected = errors.New("not connected")
+
+// startDiscovery starts listing the meters of the cloud in the background.
+func (c *openstackCloud) startDiscovery() {
+	c.discovery = &meterDiscovery{cloud: c, interval: c.config.Discovery.RefreshInterval}
+	go c.discovery.refreshLoop()
+}
+
+// refreshLoop refreshes the list of meters at the configured interval, or as soon as the cloud
+// is connected if it is not yet.
+func (d *meterDiscovery) refreshLoop() {
+	for {
+		err := d.refresh()
+		if err == errNotConnected {
+			time.Sleep(minConnectBackoff)
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to discover meters of cloud %s: %v", d.cloud.config.Name, err)
+		}
+		time.Sleep(d.interval)
+	}
+}
+
+// meterListOpts asks for at most limit meters, each listed once rather than once for every
+// resource having it if unique is set.
+type meterListOpts struct {
+	unique bool
+	limit  int
+}
+
+func (opts meterListOpts) ToMeterListQuery() (string, error) {
+	query := url.Values{"limit": {strconv.Itoa(opts.limit)}}
+	if opts.unique {
+		query.Set("unique", "True")
+	}
+	return "?" + query.Encode(), nil
+}
+
+// refresh lists the meters, stopping the requests after the discovery timeout.
+func (d *meterDiscovery) refresh() error {
+	cloud := d.cloud
+	cloud.mu.RLock()
+	connected, client := cloud.connected, cloud.client
+	cloud.mu.RUnlock()
+	if !connected {
+		return errNotConnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cloud.config.Discovery.Timeout)
+	defer cancel()
+	client = withContext(ctx, client)
+	limit := cloud.config.Discovery.MaxMeters
+	list, err := meters.List(client, meterListOpts{unique: true, limit: limit}).Extract()
+	// Releases of Ceilometer without the unique option reject it
+	if responseErr, ok := err.(*gophercloud.UnexpectedResponseCodeError); ok && responseErr.Actual == http.StatusBadRequest {
+		log.Debugf("Listing unique meters of cloud %s failed, listing them by resource: %v", cloud.config.Name, err)
+		list, err = meters.List(client, meterListOpts{limit: limit}).Extract()
+	}
+	if err != nil {
+		d.mu.Lock()
+		d.refreshFailures++
+		d.mu.Unlock()
+		return err
+	}
+	if len(list) >= limit {
+		log.Warnf("Listed %d meters of cloud %s, the most allowed by max_meters, some meters may not be discovered", len(list), cloud.config.Name)
+	}
+
+	// Without the unique option, the API lists each meter once for every resource having it
+	units := make(map[string]string)
+	for _, meter := range list {
+		units[meter.Name] = meter.Unit
+	}
+	available := make(map[string]bool, len(units))
+	var undefined []string
+	for name := range units {
+		available[name] = true
+		if _, ok := cloud.config.definitions[name]; !ok {
+			undefined = append(undefined, name)
+		}
+	}
+	sort.Strings(undefined)
+
+	// Meters are skipped if their generic name is already taken, by a defined meter, a metric of
+	// the exporter or another discovered meter
+	exportedBy := newMetricNameOwners()
+	for name, definition := range cloud.config.definitions {
+		exportedBy.add(name, definition)
+	}
+	definitions := make(map[string]MeterDefinition, len(undefined))
+	for _, name := range undefined {
+		definition := discoveredDefinition(name, units[name], cloud.config.commonLabels)
+		if definition.Metric == "" {
+			log.Warnf("Not exporting discovered meter %q of cloud %s, as it has no valid metric name", name, cloud.config.Name)
+			continue
+		}
+		if err := exportedBy.check(name, definition); err != nil {
+			log.Warnf("Not exporting discovered meter of cloud %s: %v", cloud.config.Name, err)
+			continue
+		}
+		exportedBy.add(name, definition)
+		definitions[name] = definition
+	}
+	log.Debugf("Discovered %d meters of cloud %s, %d without a definition", len(available), cloud.config.Name, len(undefined))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.available = available
+	d.definitions = definitions
+	d.refreshed = time.Now()
+	return nil
+}
+
+// meters returns the names of the available meters and the definitions of those that have no
+// definition of their own, or false if they have not been listed yet. The maps must not be
+// modified.
+func (d *meterDiscovery) meters() (map[string]bool, map[string]MeterDefinition, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.available, d.definitions, !d.refreshed.IsZero()
+}
+
+func (d *meterDiscovery) stats() (refreshed time.Time, refreshFailures int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.refreshed, d.refreshFailures
+}
+
+var (
+	invalidMetricNameCharacters = regexp.MustCompile(`[^a-z0-9_]+`)
+	unitNames                   = map[string]string{
+		"B":  "bytes",
+		"KB": "kilobytes",
+		"MB": "megabytes",
+		"GB": "gigabytes",
+		"s":  "seconds",
+		"ns": "nanoseconds",
+		"%":  "percent",
+		"W":  "watts",
+		"J":  "joules",
+		"C":  "celsius",
+	}
+	// Names of units that a rate is given per, such as the s of B/s
+	perUnitNames = map[string]string{
+		"s":   "second",
+		"min": "minute",
+		"h":   "hour",
+	}
+)
+
+// discoveredDefinition returns the generic definition of a meter without one. The metric is
+// named after the meter, with the unit appended unless the name already contains it, and has a
+// resource_id label and the common labels of the meter definitions.
+func discoveredDefinition(name, unit string, commonLabels []LabelDefinition) MeterDefinition {
+	metric := sanitizeMetricName(name)
+	if suffix := unitSuffix(unit); suffix != "" && metric != "" && !strings.Contains(metric, suffix) {
+		metric += "_" + suffix
+	}
+	help := fmt.Sprintf("Ceilometer meter %s, discovered in the cloud", name)
+	if unit != "" {
+		help = fmt.Sprintf("Ceilometer meter %s in %s, discovered in the cloud", name, unit)
+	}
+	definition := MeterDefinition{
+		Metric: metric,
+		Help:   help,
+		Labels: []LabelDefinition{{Name: "resource_id", From: "resource_id"}},
+	}
+	for _, label := range commonLabels {
+		if definition.labelIndex(label.Name) < 0 {
+			definition.Labels = append(definition.Labels, label)
+		}
+	}
+	return definition
+}
+
+// sanitizeMetricName returns name as a valid metric name, prefixed by meter_ if it starts with a
+// digit, as required of defined meters.
+func sanitizeMetricName(name string) string {
+	name = sanitizeName(name)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "meter_" + name
+	}
+	return name
+}
+
+// sanitizeName returns name in lower case with other characters than letters and digits
+// replaced by _.
+func sanitizeName(name string) string {
+	return strings.Trim(invalidMetricNameCharacters.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+// unitSuffix returns the metric name suffix for a unit, such as bytes_per_second for B/s.
+func unitSuffix(unit string) string {
+	parts := strings.Split(unit, "/")
+	for i, part := range parts {
+		names := unitNames
+		if i > 0 {
+			names = perUnitNames
+		}
+		if name, ok := names[part]; ok {
+			parts[i] = name
+		} else {
+			parts[i] = sanitizeName(part)
+		}
+	}
+	return strings.Trim(strings.Join(parts, "_per_"), "_")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rackspace/gophercloud"
+)
+
+func TestDiscoveredDefinition(t *testing.T) {
+	for _, test := range []struct {
+		name, unit, metric string
+	}{
+		{"cpu", "ns", "cpu_nanoseconds"},
+		{"memory.usage", "MB", "memory_usage_megabytes"},
+		{"disk.read.bytes", "B", "disk_read_bytes"},
+		{"network.incoming.bytes.rate", "B/s", "network_incoming_bytes_rate_bytes_per_second"},
+		{"vcpus", "vcpu", "vcpus"},
+		{"hardware.cpu.load.1min", "process", "hardware_cpu_load_1min_process"},
+		{"custom-Meter", "", "custom_meter"},
+		{"5min.load", "", "meter_5min_load"},
+		{".1min", "1/s", "meter_1min_1_per_second"},
+	} {
+		definition := discoveredDefinition(test.name, test.unit, nil)
+		if definition.Metric != test.metric {
+			t.Errorf("expected %s in %s to be exported as %s, got %s", test.name, test.unit, test.metric, definition.Metric)
+		}
+		if !validMetricName.MatchString(definition.Metric) {
+			t.Errorf("expected %s to be exported under a valid name, got %s", test.name, definition.Metric)
+		}
+	}
+
+	commonLabels := []LabelDefinition{{Name: "resource_id", From: "metadata.instance_id"}, {Name: "project_id", From: "project_id"}}
+	definition := discoveredDefinition("custom", "", commonLabels)
+	if len(definition.Labels) != 2 || definition.Labels[0].From != "resource_id" || definition.Labels[1].Name != "project_id" {
+		t.Errorf("expected the common labels to be added to resource_id, got %v", definition.Labels)
+	}
+}
+
+func TestMeterDiscovery(t *testing.T) {
+	// The API is that of a release without the unique option, which lists meters by resource
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/meters" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("unique") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error_message": {"faultstring": "Unknown argument: \"unique\""}}`))
+			return
+		}
+		w.Write([]byte(`[
+			{"name": "cpu", "type": "cumulative", "unit": "ns", "resource_id": "i1"},
+			{"name": "custom.rate", "type": "gauge", "unit": "B/s", "resource_id": "i1"},
+			{"name": "custom.rate", "type": "gauge", "unit": "B/s", "resource_id": "i2"},
+			{"name": "Memory", "type": "gauge", "unit": "", "resource_id": "i1"},
+			{"name": "disk.usage.avg", "type": "gauge", "unit": "", "resource_id": "i1"},
+			{"name": "up", "type": "gauge", "unit": "", "resource_id": "i1"}
+		]`))
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.definitions = map[string]MeterDefinition{
+		"cpu":        {Metric: "cpu", Help: "CPU time"},
+		"memory":     {Metric: "memory", Help: "Memory"},
+		"disk.usage": {Metric: "disk_usage", Help: "Disk usage", Mode: meterModeStatistics, Statistics: []string{"avg"}},
+	}
+	config.commonLabels = []LabelDefinition{{Name: "project_id", From: "project_id"}}
+	cloud := &openstackCloud{
+		config:    config,
+		connected: true,
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	cloud.discovery = &meterDiscovery{cloud: cloud, interval: time.Minute}
+	if err := cloud.discovery.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || queries[0] != "limit=1000&unique=True" || queries[1] != "limit=1000" {
+		t.Errorf("expected unique meters to be listed, and then all meters, got %q", queries)
+	}
+
+	// Memory, disk.usage.avg and up would be exported under the name of memory, of the average
+	// of disk.usage and of a metric of the exporter, and are skipped
+	available, definitions, ok := cloud.discovery.meters()
+	if !ok || len(available) != 5 || len(definitions) != 1 || definitions["custom.rate"].Metric != "custom_rate_bytes_per_second" {
+		t.Errorf("unexpected discovered meters %v, definitions %v", available, definitions)
+	}
+	if labels := definitions["custom.rate"].Labels; len(labels) != 2 || labels[1].Name != "project_id" {
+		t.Errorf("expected the common labels on discovered meters, got %v", labels)
+	}
+
+	collector := NewCeilometerCollector(cloud, MetricSelection{EnabledMetrics: []string{"*"}})
+	ch := make(chan prometheus.Metric, 20)
+	metrics := collector.withDiscovered(ch, time.Now())
+	close(ch)
+	if _, ok := metrics["custom.rate"]; !ok || len(metrics) != 4 {
+		t.Errorf("expected the defined and discovered meters, got %v", metrics)
+	}
+
+	availability := make(map[string]float64)
+	for m := range ch {
+		if m.Desc() != collector.metaMetrics["meterAvailable"] {
+			continue
+		}
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		labels := make(map[string]string)
+		for _, label := range out.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		availability[labels["meter"]+"/"+labels["defined"]] = out.GetGauge().GetValue()
+	}
+	expected := map[string]float64{"cpu/true": 1, "memory/true": 0, "disk.usage/true": 0, "custom.rate/false": 1, "Memory/false": 1, "disk.usage.avg/false": 1, "up/false": 1}
+	if len(availability) != len(expected) {
+		t.Errorf("expected availability %v, got %v", expected, availability)
+	}
+	for key, value := range expected {
+		if v, ok := availability[key]; !ok || v != value {
+			t.Errorf("expected availability %v, got %v", expected, availability)
+		}
+	}
+}
+
+func TestMeterDiscoveryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := defaultConfig()
+	config.Discovery.Timeout = 50 * time.Millisecond
+	cloud := &openstackCloud{
+		config:    config,
+		connected: true,
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	cloud.discovery = &meterDiscovery{cloud: cloud, interval: time.Minute}
+
+	start := time.Now()
+	if err := cloud.discovery.refresh(); err == nil {
+		t.Error("expected the refresh to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the timeout to stop the refresh, took %v", elapsed)
+	}
+	if _, failures := cloud.discovery.stats(); failures != 1 {
+		t.Errorf("expected a refresh failure, got %d", failures)
+	}
+}
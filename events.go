@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rackspace/gophercloud"
+	"github.com/ryanuber/go-glob"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// eventsMetric is the name under which the events are enabled or disabled, like a meter.
+const eventsMetric = "events"
+
+type event struct {
+	MessageID string       `json:"message_id"`
+	EventType string       `json:"event_type"`
+	Generated string       `json:"generated"`
+	Traits    []eventTrait `json:"traits"`
+
+	generated time.Time
+}
+
+type eventTrait struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// listEvents returns up to limit of the events generated from start to end, both included, in
+// no particular order.
+func listEvents(client *gophercloud.ServiceClient, start, end time.Time, limit int) ([]event, error) {
+	query := url.Values{
+		"q.field": {"start_timestamp", "end_timestamp"},
+		"q.op":    {"ge", "le"},
+		"q.value": {start.UTC().Format(timestampFormat), end.UTC().Format(timestampFormat)},
+		"limit":   {strconv.Itoa(limit)},
+	}
+	var events []event
+	// The JSON decoder fills in the value response points to
+	var response interface{} = &events
+	if _, err := client.Get(client.ServiceURL("v2", "events")+"?"+query.Encode(), &response, nil); err != nil {
+		return nil, err
+	}
+	for i := range events {
+		generated, err := parseTimestamp(events[i].Generated)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of event %s: %v", events[i].MessageID, err)
+		}
+		events[i].generated = generated
+	}
+	return events, nil
+}
+
+// eventCounter counts the events of a cloud by type and selected traits. The counts are
+// shared by all collectors of the cloud, and new events are fetched on each scrape. The time of
+// the newest event counted is kept as a high-water mark, and events are read again from the
+// configured lateness before it, so that those reaching the API late are still counted. To
+// count every event once, the ids of the events counted within that time are kept. When a
+// state directory is configured, these are saved together with the counts after each update,
+// so that a restarted exporter resumes where it stopped.
+type eventCounter struct {
+	config     EventsConfig
+	maxResults int
+	statePath  string
+
+	mu    sync.Mutex
+	state eventState
+}
+
+type eventState struct {
+	HighWaterMark time.Time `json:"high_water_mark"`
+	// Seen holds the generation times of the events counted, by id
+	Seen   map[string]time.Time `json:"seen"`
+	Traits []string             `json:"traits"`
+	Counts []*eventSum          `json:"counts"`
+
+	counts map[string]*eventSum
+}
+
+// eventSum is the number of events with the same values of the event type and traits.
+type eventSum struct {
+	Labels []string `json:"labels"`
+	Count  float64  `json:"count"`
+}
+
+var unsafeFilenameCharacters = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// newEventCounter creates the counter for the events of a cloud, restoring the saved state if
+// there is any. Without it, only events from now on are counted.
+func newEventCounter(config *Config) (*eventCounter, error) {
+	counter := &eventCounter{
+		config:     config.Events,
+		maxResults: config.MaxResults,
+		state: eventState{
+			HighWaterMark: time.Now().UTC().Truncate(time.Microsecond),
+			Traits:        config.Events.Traits,
+			Seen:          make(map[string]time.Time),
+			counts:        make(map[string]*eventSum),
+		},
+	}
+	if config.Events.StateDir == "" {
+		return counter, nil
+	}
+
+	filename := "events-" + unsafeFilenameCharacters.ReplaceAllString(config.Name, "_") + ".json"
+	counter.statePath = filepath.Join(config.Events.StateDir, filename)
+	content, err := ioutil.ReadFile(counter.statePath)
+	if os.IsNotExist(err) {
+		return counter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved eventState
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", counter.statePath, err)
+	}
+
+	counter.state.HighWaterMark = saved.HighWaterMark
+	for id, generated := range saved.Seen {
+		counter.state.Seen[id] = generated
+	}
+	// Counts by other traits cannot be continued, and start over
+	if strings.Join(saved.Traits, ",") == strings.Join(config.Events.Traits, ",") {
+		for _, sum := range saved.Counts {
+			counter.state.counts[strings.Join(sum.Labels, "\xff")] = sum
+		}
+	} else {
+		log.Infof("Traits of event counts changed, starting over from %v", saved.HighWaterMark)
+	}
+	return counter, nil
+}
+
+// update counts the events generated from the lateness before the high-water mark until now.
+// These are all read, with listTimeWindow, before any is counted, as the API does not return
+// them in order, and the mark moves to the newest one. Events already counted are skipped by
+// their id, and the ids are forgotten once the next update no longer reads their time.
+func (c *eventCounter) update(client *gophercloud.ServiceClient) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := c.state.HighWaterMark.Add(-c.config.Lateness)
+	end := time.Now().UTC().Truncate(time.Microsecond)
+	if end.Before(c.state.HighWaterMark) {
+		return nil
+	}
+	var events []event
+	complete, err := listTimeWindow(start, end, c.maxResults, func(start, end time.Time) (int, error) {
+		page, err := listEvents(client, start, end, c.maxResults)
+		events = append(events, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return err
+	}
+	if !complete {
+		log.Warnf("More than %d events were generated at the same time, some of them are not counted", c.maxResults)
+	}
+
+	for _, event := range events {
+		if _, ok := c.state.Seen[event.MessageID]; ok || event.generated.Before(start) {
+			continue
+		}
+		if event.generated.After(c.state.HighWaterMark) {
+			c.state.HighWaterMark = event.generated
+		}
+		c.state.Seen[event.MessageID] = event.generated
+		if c.counted(event.EventType) {
+			c.add(event)
+		}
+	}
+	oldest := c.state.HighWaterMark.Add(-c.config.Lateness)
+	for id, generated := range c.state.Seen {
+		if generated.Before(oldest) {
+			delete(c.state.Seen, id)
+		}
+	}
+	c.save()
+	return nil
+}
+
+func (c *eventCounter) counted(eventType string) bool {
+	for _, pattern := range c.config.EventTypes {
+		if glob.Glob(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *eventCounter) add(event event) {
+	labels := make([]string, 1+len(c.config.Traits))
+	labels[0] = event.EventType
+	for i, name := range c.config.Traits {
+		for _, trait := range event.Traits {
+			if trait.Name == name {
+				labels[i+1] = formatMetadataValue(trait.Value)
+			}
+		}
+	}
+	key := strings.Join(labels, "\xff")
+	sum, ok := c.state.counts[key]
+	if !ok {
+		sum = &eventSum{Labels: labels}
+		c.state.counts[key] = sum
+	}
+	sum.Count++
+}
+
+// save writes the state to a new file, which replaces the old one only once complete. Must be
+// called with mu held.
+func (c *eventCounter) save() {
+	if c.statePath == "" {
+		return
+	}
+	c.state.Counts = c.state.Counts[:0]
+	for _, sum := range c.state.counts {
+		c.state.Counts = append(c.state.Counts, sum)
+	}
+	content, err := json.Marshal(c.state)
+	if err == nil {
+		temporary := c.statePath + ".tmp"
+		if err = ioutil.WriteFile(temporary, content, 0600); err == nil {
+			err = os.Rename(temporary, c.statePath)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to save event counts, events may be counted again after a restart: %v", err)
+	}
+}
+
+// sums returns a copy of the current counts, along with the high-water mark.
+func (c *eventCounter) sums() ([]eventSum, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sums := make([]eventSum, 0, len(c.state.counts))
+	for _, sum := range c.state.counts {
+		sums = append(sums, *sum)
+	}
+	return sums, c.state.HighWaterMark
+}
+
+// eventCollector exports the event counts of a cloud.
+type eventCollector struct {
+	cloud       *openstackCloud
+	count       *prometheus.Desc
+	metaMetrics map[string]*prometheus.Desc
+}
+
+// NewEventCollector creates a collector for the events of cloud, which must have an event
+// counter. It is registered alongside the ceilometerCollector of the cloud if events are
+// enabled by its metric selection.
+func NewEventCollector(cloud *openstackCloud) *eventCollector {
+	constLabels := cloud.constLabels()
+	labels := append([]string{"event_type"}, cloud.config.Events.Traits...)
+	return &eventCollector{
+		cloud: cloud,
+		count: prometheus.NewDesc(makeFQName("events_total"), "Number of events by type and traits", labels, constLabels),
+		metaMetrics: map[string]*prometheus.Desc{
+			"scrapeSuccess":  prometheus.NewDesc(makeFQName("events_scrape_success"), "Indicates if the events were successfully scraped", nil, constLabels),
+			"scrapeDuration": prometheus.NewDesc(makeFQName("events_scrape_duration_ns"), "The time taken to scrape the events", nil, constLabels),
+			"highWaterMark":  prometheus.NewDesc(makeFQName("events_high_water_mark_timestamp_seconds"), "Time of the newest event counted, or of the start of counting", nil, constLabels),
+		},
+	}
+}
+
+func (c *eventCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.count
+	for _, desc := range c.metaMetrics {
+		ch <- desc
+	}
+}
+
+func (c *eventCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+// CollectWithContext counts the new events, stopping the requests when ctx is done, and sends
+// the counts. Nothing is exported if the cloud has no events API.
+func (c *eventCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t := time.Now()
+
+	cloud := c.cloud
+	cloud.mu.RLock()
+	connected, client := cloud.connected, cloud.eventClient
+	cloud.mu.RUnlock()
+	if !connected || client == nil {
+		return
+	}
+
+	err := cloud.events.update(withContext(ctx, client))
+	if err != nil {
+		log.Warnf("Failed to scrape events of cloud %s: %v", cloud.config.Name, err)
+	}
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeSuccess"], prometheus.GaugeValue, btof(err == nil))
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeDuration"], prometheus.GaugeValue, float64(time.Since(t).Nanoseconds()))
+
+	sums, highWaterMark := cloud.events.sums()
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["highWaterMark"], prometheus.GaugeValue, float64(highWaterMark.UnixNano())/float64(time.Second))
+	for _, sum := range sums {
+		ch <- prometheus.MustNewConstMetric(c.count, prometheus.CounterValue, sum.Count, sum.Labels...)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+)
+
+// newEventServer serves the events generated in the queried window, newest first and limited
+// as requested, so that the oldest ones are left out of full pages. Requests are counted in
+// requests.
+func newEventServer(t *testing.T, events *[]map[string]interface{}, requests *int) (*httptest.Server, *gophercloud.ServiceClient) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		query := r.URL.Query()
+		values := query["q.value"]
+		if fmt.Sprint(query["q.field"]) != "[start_timestamp end_timestamp]" || fmt.Sprint(query["q.op"]) != "[ge le]" || len(values) != 2 {
+			t.Fatalf("unexpected query %q", r.URL.RawQuery)
+		}
+		start, err := time.Parse(timestampFormat, values[0])
+		if err != nil {
+			t.Errorf("invalid timestamp in query %q: %v", r.URL.RawQuery, err)
+		}
+		end, err := time.Parse(timestampFormat, values[1])
+		if err != nil {
+			t.Errorf("invalid timestamp in query %q: %v", r.URL.RawQuery, err)
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page := []map[string]interface{}{}
+		for i := len(*events) - 1; i >= 0 && len(page) < limit; i-- {
+			event := (*events)[i]
+			generated, _ := time.Parse(timestampFormat, event["generated"].(string))
+			if !generated.Before(start) && !generated.After(end) {
+				page = append(page, event)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+	return server, client
+}
+
+func testEvent(id, eventType string, generated time.Time, project string) map[string]interface{} {
+	return map[string]interface{}{
+		"message_id": id,
+		"event_type": eventType,
+		"generated":  generated.Format(timestampFormat),
+		"traits": []map[string]interface{}{
+			{"name": "project_id", "type": "string", "value": project},
+			{"name": "size", "type": "integer", "value": 1024},
+		},
+	}
+}
+
+func TestEventCounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.Name = "test/cloud"
+	config.MaxResults = 2
+	config.Events = EventsConfig{EventTypes: []string{"image.*"}, Traits: []string{"project_id"}, StateDir: dir}
+	counter, err := newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events are only read until now
+	counter.state.HighWaterMark = counter.state.HighWaterMark.Add(-time.Minute)
+
+	start := counter.state.HighWaterMark.Add(time.Second)
+	events := []map[string]interface{}{
+		testEvent("e0", "image.upload", start.Add(-time.Hour), "p1"),
+		testEvent("e1", "image.upload", start, "p1"),
+		testEvent("e2", "image.upload", start.Add(time.Second), "p1"),
+		testEvent("e3", "image.delete", start.Add(time.Second), "p2"),
+		testEvent("e4", "port.create", start.Add(2*time.Second), "p1"),
+	}
+	var requests int
+	server, client := newEventServer(t, &events, &requests)
+	defer server.Close()
+
+	expectCounts := func(counter *eventCounter, expected map[string]float64) {
+		t.Helper()
+		sums, _ := counter.sums()
+		counts := make(map[string]float64)
+		for _, sum := range sums {
+			counts[sum.Labels[0]+"/"+sum.Labels[1]] = sum.Count
+		}
+		if len(counts) != len(expected) {
+			t.Errorf("expected counts %v, got %v", expected, counts)
+		}
+		for labels, count := range expected {
+			if counts[labels] != count {
+				t.Errorf("expected counts %v, got %v", expected, counts)
+			}
+		}
+	}
+
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+	// The first page holds only the newest events, so the window is split until none is full
+	expectCounts(counter, map[string]float64{"image.upload/p1": 2, "image.delete/p2": 1})
+	if requests < 3 {
+		t.Errorf("expected the window to be split, got %d requests", requests)
+	}
+
+	// Events at the high-water mark are returned again, and not counted twice
+	events = append(events, testEvent("e5", "image.upload", start.Add(2*time.Second), "p1"))
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+	expectCounts(counter, map[string]float64{"image.upload/p1": 3, "image.delete/p2": 1})
+
+	// A restarted exporter continues from the saved state
+	restarted, err := newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.update(client); err != nil {
+		t.Fatal(err)
+	}
+	expectCounts(restarted, map[string]float64{"image.upload/p1": 3, "image.delete/p2": 1})
+
+	// Counts by other traits start over, without counting past events again
+	config.Events.Traits = []string{"size"}
+	restarted, err = newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events = append(events, testEvent("e6", "image.upload", start.Add(3*time.Second), "p1"))
+	if err := restarted.update(client); err != nil {
+		t.Fatal(err)
+	}
+	expectCounts(restarted, map[string]float64{"image.upload/1024": 1})
+}
+
+func TestEventCounterSameTimestamp(t *testing.T) {
+	config := defaultConfig()
+	config.MaxResults = 2
+	counter, err := newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.state.HighWaterMark = counter.state.HighWaterMark.Add(-time.Minute)
+
+	// More events than a page at the same time cannot be told apart by their time
+	at := counter.state.HighWaterMark.Add(time.Second)
+	events := []map[string]interface{}{
+		testEvent("e1", "image.upload", at, "p1"),
+		testEvent("e2", "image.upload", at, "p1"),
+		testEvent("e3", "image.upload", at, "p1"),
+	}
+	var requests int
+	server, client := newEventServer(t, &events, &requests)
+	defer server.Close()
+
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+	sums, mark := counter.sums()
+	if len(sums) != 1 || sums[0].Count != 2 {
+		t.Errorf("expected a page of the events to be counted, got %v", sums)
+	}
+	if !mark.Equal(at) {
+		t.Errorf("expected the high-water mark at %v, got %v", at, mark)
+	}
+	// Each split of the minute and the lateness leading to the events takes two requests
+	if requests > 2*30 {
+		t.Errorf("expected the window to stop being split at the time of the events, got %d requests", requests)
+	}
+}
+
+func TestEventCounterLateEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.Events = EventsConfig{EventTypes: []string{"*"}, StateDir: dir, Lateness: time.Minute}
+	counter, err := newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.state.HighWaterMark = counter.state.HighWaterMark.Add(-time.Minute)
+
+	// Nothing was generated yet, but the state is saved all the same
+	var events []map[string]interface{}
+	var requests int
+	server, client := newEventServer(t, &events, &requests)
+	defer server.Close()
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(counter.statePath); err != nil {
+		t.Errorf("expected the state to be saved: %v", err)
+	}
+
+	mark := counter.state.HighWaterMark
+	events = append(events, testEvent("e1", "image.upload", mark.Add(time.Second), "p1"))
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events reaching the API after newer ones are counted within the lateness, once
+	events = append(events,
+		testEvent("e2", "image.upload", mark.Add(-30*time.Second), "p1"),
+		testEvent("e3", "image.upload", mark.Add(-2*time.Minute), "p1"),
+	)
+	for i := 0; i < 2; i++ {
+		if err := counter.update(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sums, _ := counter.sums(); len(sums) != 1 || sums[0].Count != 2 {
+		t.Errorf("expected the events within the lateness to be counted, got %v", sums)
+	}
+
+	// The ids of events the next update no longer reads are forgotten
+	events = append(events, testEvent("e4", "image.upload", mark.Add(55*time.Second), "p1"))
+	if err := counter.update(client); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newEventCounter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.state.Seen["e2"]; ok || len(restarted.state.Seen) != 2 {
+		t.Errorf("expected the ids of e1 and e4 to be saved, got %v", restarted.state.Seen)
+	}
+}
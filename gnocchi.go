@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// gnocchiBackend reads meters from Gnocchi, where newer releases of Ceilometer store their
+// measures. A meter is a metric of each resource it was measured on, so the measures of the
+// metric of all resources are read at once from the aggregates API, at the aggregation and
+// granularity of the meter, along with the resources. The resource attributes take the place of
+// the sample metadata.
+type gnocchiBackend struct{}
+
+// gnocchiResource is a resource having the metric of a meter.
+type gnocchiResource struct {
+	metricID string
+	// sample holds the fields of the resource, shared by the samples made from its measures
+	sample meters.OldSample
+	// measures are those of the metric in the query window, in the order given by Gnocchi,
+	// which is oldest first for each granularity, the finest last
+	measures []gnocchiMeasure
+}
+
+type gnocchiMeasure struct {
+	timestamp time.Time
+	value     float64
+}
+
+// samples returns the latest measure of each resource in the query window. Gnocchi does not
+// keep the sample types, so they are left empty for the sample type of the meter definition.
+func (b gnocchiBackend) samples(client *gophercloud.ServiceClient, meterName string, settings MeterConfig) ([]meters.OldSample, bool, error) {
+	resources, truncated, err := b.resources(client, meterName, settings)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var samples []meters.OldSample
+	for _, resource := range resources {
+		if len(resource.measures) == 0 {
+			continue
+		}
+		latest := resource.measures[len(resource.measures)-1]
+		sample := resource.sample
+		sample.Volume = latest.value
+		sample.Timestamp = latest.timestamp
+		sample.MessageId = resource.metricID + "@" + latest.timestamp.String()
+		samples = append(samples, sample)
+	}
+	return samples, truncated, nil
+}
+
+// statistics aggregates the measures in the query window, grouping the resources as the
+// statistics API groups samples.
+func (b gnocchiBackend) statistics(client *gophercloud.ServiceClient, meterName string, settings MeterConfig, groupBy []string) ([]meters.Statistics, error) {
+	resources, truncated, err := b.resources(client, meterName, settings)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		log.Warnf("Statistics of %v are limited to the first %d resources", meterName, settings.MaxSamples)
+	}
+
+	var groups []meters.Statistics
+	groupIndex := make(map[string]int)
+	for _, resource := range resources {
+		if len(resource.measures) == 0 {
+			continue
+		}
+
+		values := make(map[string]string, len(groupBy))
+		key := make([]string, len(groupBy))
+		for i, field := range groupBy {
+			// Metadata fields are named as by the statistics API
+			if strings.HasPrefix(field, "resource_metadata.") {
+				values[field], _ = sampleField(&resource.sample, strings.TrimPrefix(field, "resource_"))
+			} else {
+				values[field], _ = sampleField(&resource.sample, field)
+			}
+			key[i] = values[field]
+		}
+		i, ok := groupIndex[strings.Join(key, "\xff")]
+		if !ok {
+			i = len(groups)
+			groupIndex[strings.Join(key, "\xff")] = i
+			groups = append(groups, meters.Statistics{Min: math.Inf(1), Max: math.Inf(-1), GroupBy: values})
+		}
+
+		group := &groups[i]
+		for _, measure := range resource.measures {
+			group.Count++
+			group.Sum += measure.value
+			group.Min = math.Min(group.Min, measure.value)
+			group.Max = math.Max(group.Max, measure.value)
+		}
+	}
+	for i := range groups {
+		groups[i].Avg = groups[i].Sum / float64(groups[i].Count)
+	}
+	return groups, nil
+}
+
+// gnocchiAggregates is the response of the aggregates API for the measures of a metric of the
+// resources found by a search. Measures are keyed by resource id, metric name and aggregation,
+// and the references are the resources.
+type gnocchiAggregates struct {
+	Measures   map[string]map[string]map[string][][]interface{} `json:"measures"`
+	References []map[string]interface{}                         `json:"references"`
+}
+
+// resources reads the resources having the metric of a meter, up to settings.MaxSamples of them
+// in the order of their ids, with their measures in the query window. Filters are sent as the
+// resource search.
+func (gnocchiBackend) resources(client *gophercloud.ServiceClient, meterName string, settings MeterConfig) ([]gnocchiResource, bool, error) {
+	// The aggregates API requires a search, which matches every resource without filters
+	var search interface{} = map[string]interface{}{"like": map[string]interface{}{"original_resource_id": "%"}}
+	if len(settings.Filters) > 0 {
+		conditions := make([]interface{}, len(settings.Filters))
+		for i, filter := range settings.Filters {
+			var value interface{} = filter.Value
+			if filter.op() == "in" {
+				value = filter.Values
+			}
+			conditions[i] = complexCondition(filter.op(), gnocchiAttribute(filter.Field), value)
+		}
+		search = map[string]interface{}{"and": conditions}
+	}
+	query := url.Values{
+		"details": {"true"},
+		"start":   {time.Now().UTC().Add(-settings.MaxMetricAge).Format(time.RFC3339)},
+	}
+	if settings.Granularity > 0 {
+		query.Set("granularity", strconv.FormatFloat(settings.Granularity.Seconds(), 'f', -1, 64))
+	}
+	body := map[string]interface{}{
+		"operations":    []interface{}{"metric", meterName, settings.Aggregation},
+		"resource_type": "generic",
+		"search":        search,
+	}
+
+	log.Debugf("Querying aggregates for %v: %v", meterName, body)
+	var aggregates gnocchiAggregates
+	err := gnocchiRequest(client, client.ServiceURL("v1", "aggregates")+"?"+query.Encode(), body, &aggregates)
+	if isGnocchiMetricNotFound(err) {
+		// None of the resources found has the metric
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	sort.Slice(aggregates.References, func(i, j int) bool {
+		id, _ := aggregates.References[i]["id"].(string)
+		other, _ := aggregates.References[j]["id"].(string)
+		return id < other
+	})
+	var resources []gnocchiResource
+	for _, attributes := range aggregates.References {
+		resource, ok := newGnocchiResource(attributes, meterName)
+		if !ok {
+			continue
+		}
+		if len(resources) >= settings.MaxSamples {
+			return resources, true, nil
+		}
+		id, _ := attributes["id"].(string)
+		if resource.measures, err = parseGnocchiMeasures(aggregates.Measures[id][meterName][settings.Aggregation], resource.metricID); err != nil {
+			return nil, false, err
+		}
+		resources = append(resources, resource)
+	}
+	return resources, false, nil
+}
+
+// isGnocchiMetricNotFound reports whether err is the rejection of an aggregation of a metric
+// that none of the resources searched has.
+func isGnocchiMetricNotFound(err error) bool {
+	responseErr, ok := err.(*gophercloud.UnexpectedResponseCodeError)
+	if !ok || responseErr.Actual != http.StatusBadRequest {
+		return false
+	}
+	body := string(responseErr.Body)
+	return strings.Contains(body, "does not exist") || strings.Contains(body, "not found")
+}
+
+// newGnocchiResource returns the resource described by the attributes, if it has the metric
+// of the meter. Gnocchi identifies resources by UUIDs derived from the ids used by Ceilometer,
+// which are kept as the original resource id.
+func newGnocchiResource(attributes map[string]interface{}, meterName string) (gnocchiResource, bool) {
+	metrics, _ := attributes["metrics"].(map[string]interface{})
+	metricID, ok := metrics[meterName].(string)
+	if !ok {
+		return gnocchiResource{}, false
+	}
+
+	resourceID, _ := attributes["original_resource_id"].(string)
+	if resourceID == "" {
+		resourceID, _ = attributes["id"].(string)
+	}
+	metadata := make(map[string]interface{}, len(attributes))
+	for key, value := range attributes {
+		if key != "metrics" {
+			metadata[key] = value
+		}
+	}
+	// Ceilometer includes the instance id in the metadata of instances, Gnocchi does not
+	if _, ok := metadata["instance_id"]; !ok && attributes["type"] == "instance" {
+		metadata["instance_id"] = resourceID
+	}
+	// Gnocchi flattens the flavor of instances, which Ceilometer has as a nested object
+	if _, ok := metadata["flavor"]; !ok && (attributes["flavor_id"] != nil || attributes["flavor_name"] != nil) {
+		metadata["flavor"] = map[string]interface{}{"id": attributes["flavor_id"], "name": attributes["flavor_name"]}
+	}
+
+	sample := meters.OldSample{
+		Name:             meterName,
+		ResourceId:       resourceID,
+		ResourceMetadata: metadata,
+	}
+	sample.ProjectId, _ = attributes["project_id"].(string)
+	sample.UserId, _ = attributes["user_id"].(string)
+	return gnocchiResource{metricID: metricID, sample: sample}, true
+}
+
+// parseGnocchiMeasures reads the measures of a metric. Each is a list of its timestamp,
+// granularity and value.
+func parseGnocchiMeasures(points [][]interface{}, metricID string) ([]gnocchiMeasure, error) {
+	measures := make([]gnocchiMeasure, 0, len(points))
+	for _, point := range points {
+		if len(point) != 3 {
+			return nil, fmt.Errorf("invalid measure %v of metric %s", point, metricID)
+		}
+		rawTimestamp, _ := point[0].(string)
+		timestamp, err := time.Parse(time.RFC3339, rawTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid measure %v of metric %s: %v", point, metricID, err)
+		}
+		value, ok := point[2].(float64)
+		if !ok {
+			continue
+		}
+		measures = append(measures, gnocchiMeasure{timestamp: timestamp.UTC(), value: value})
+	}
+	return measures, nil
+}
+
+// gnocchiRequest sends a GET request, or a POST request if body is given, decoding the response
+// into out.
+func gnocchiRequest(client *gophercloud.ServiceClient, url string, body interface{}, out interface{}) error {
+	// The JSON decoder fills in the value out points to
+	response := out
+	opts := &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}}
+	var err error
+	if body == nil {
+		_, err = client.Get(url, &response, opts)
+	} else {
+		_, err = client.Post(url, body, &response, opts)
+	}
+	return err
+}
+
+// gnocchiAttribute translates a filter field to the resource attribute searched in Gnocchi.
+func gnocchiAttribute(field string) string {
+	if field == "resource_id" {
+		return "original_resource_id"
+	}
+	return strings.TrimPrefix(field, "metadata.")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rackspace/gophercloud"
+)
+
+// newGnocchiServer serves the aggregates of four instances, three of them with a cpu metric.
+// The metric of the last one has no measures in the query window. The searches sent are
+// recorded in searches.
+func newGnocchiServer(t *testing.T, searches *[]string) (*httptest.Server, *gophercloud.ServiceClient) {
+	resources := []map[string]interface{}{
+		{"id": "d", "original_resource_id": "i-d", "type": "instance", "project_id": "p1", "display_name": "vm-d", "metrics": map[string]interface{}{"cpu": "m-d"}},
+		{"id": "c", "original_resource_id": "i-c", "type": "instance", "project_id": "p1", "display_name": "vm-c", "metrics": map[string]interface{}{"cpu": "m-c"}},
+		{"id": "b", "original_resource_id": "i-b", "type": "instance", "project_id": "p2", "display_name": "vm-b", "metrics": map[string]interface{}{"memory": "m-x"}},
+		{"id": "a", "original_resource_id": "i-a", "type": "instance", "project_id": "p1", "display_name": "vm-a", "flavor_id": "f1", "flavor_name": "m1.small", "metrics": map[string]interface{}{"cpu": "m-a"}},
+	}
+	now := time.Now().UTC().Truncate(time.Minute)
+	measures := map[string][][]interface{}{
+		"a": {
+			{now.Add(-2 * time.Minute).Format(time.RFC3339), 60.0, 1.0},
+			{now.Add(-time.Minute).Format(time.RFC3339), 60.0, 3.0},
+		},
+		"c": {
+			{now.Add(-time.Minute).Format("2006-01-02T15:04:05+00:00"), 60.0, 8.0},
+		},
+		"d": {},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Method != "POST" || r.URL.Path != "/v1/aggregates" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if query.Get("details") != "true" || query.Get("granularity") != "60" || query.Get("start") == "" {
+			t.Errorf("unexpected aggregates query %q", r.URL.RawQuery)
+		}
+		var body struct {
+			Operations   []string        `json:"operations"`
+			ResourceType string          `json:"resource_type"`
+			Search       json.RawMessage `json:"search"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid aggregates request: %v", err)
+		}
+		*searches = append(*searches, string(body.Search))
+		if len(body.Operations) != 3 || body.Operations[0] != "metric" || body.Operations[2] != "max" || body.ResourceType != "generic" {
+			t.Errorf("unexpected aggregates request %+v", body)
+		}
+
+		meterName := body.Operations[1]
+		result := map[string]interface{}{}
+		var references []map[string]interface{}
+		for _, resource := range resources {
+			if _, ok := resource["metrics"].(map[string]interface{})[meterName]; ok {
+				references = append(references, resource)
+				id := resource["id"].(string)
+				result[id] = map[string]interface{}{meterName: map[string]interface{}{"max": measures[id]}}
+			}
+		}
+		if len(references) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"code": 400, "description": "Metric ['%s'] does not exist", "title": "Bad Request"}`, meterName)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"measures": result, "references": references})
+	}))
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+	return server, client
+}
+
+var testGnocchiSettings = MeterConfig{
+	MaxResults:   2,
+	MaxSamples:   10,
+	MaxMetricAge: time.Hour,
+	Aggregation:  "max",
+	Granularity:  time.Minute,
+}
+
+func TestGnocchiSamples(t *testing.T) {
+	var searches []string
+	server, client := newGnocchiServer(t, &searches)
+	defer server.Close()
+
+	samples, truncated, err := gnocchiBackend{}.samples(client, "cpu", testGnocchiSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %d (truncated: %v)", len(samples), truncated)
+	}
+	if len(searches) != 1 {
+		t.Errorf("expected the measures of all resources to be read at once, got %d requests", len(searches))
+	}
+	if sample := samples[0]; sample.ResourceId != "i-a" || sample.Volume != 3 || sample.ProjectId != "p1" || sample.Type != "" {
+		t.Errorf("expected the latest measure of i-a, got %+v", sample)
+	}
+	if flavor := metadataValue(samples[0].ResourceMetadata, "flavor.name"); flavor != "m1.small" {
+		t.Errorf("expected flavor.name m1.small, got %q", flavor)
+	}
+	if name := metadataValue(samples[1].ResourceMetadata, "display_name"); name != "vm-c" {
+		t.Errorf("expected display_name vm-c, got %q", name)
+	}
+	if id := metadataValue(samples[1].ResourceMetadata, "instance_id"); id != "i-c" {
+		t.Errorf("expected instance_id i-c, got %q", id)
+	}
+
+	settings := testGnocchiSettings
+	settings.MaxSamples = 1
+	if samples, truncated, _ := (gnocchiBackend{}).samples(client, "cpu", settings); !truncated || len(samples) != 1 {
+		t.Errorf("expected 1 sample and truncation, got %d (truncated: %v)", len(samples), truncated)
+	}
+
+	// A metric that no resource has is not an error
+	if samples, _, err := (gnocchiBackend{}).samples(client, "missing", testGnocchiSettings); err != nil || len(samples) != 0 {
+		t.Errorf("expected no samples of a missing metric, got %d: %v", len(samples), err)
+	}
+
+	settings = testGnocchiSettings
+	settings.Filters = []FilterConfig{
+		{Field: "resource_id", Op: "ne", Value: "i-b"},
+		{Field: "metadata.display_name", Op: "in", Values: []string{"vm-a", "vm-c"}},
+	}
+	if _, _, err := (gnocchiBackend{}).samples(client, "cpu", settings); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"and":[{"!=":{"original_resource_id":"i-b"}},{"in":{"display_name":["vm-a","vm-c"]}}]}`
+	if searches[len(searches)-1] != expected {
+		t.Errorf("expected search %s, got %v", expected, searches)
+	}
+}
+
+func TestGnocchiStatistics(t *testing.T) {
+	var searches []string
+	server, client := newGnocchiServer(t, &searches)
+	defer server.Close()
+
+	groups, err := gnocchiBackend{}.statistics(client, "cpu", testGnocchiSettings, []string{"project_id", "resource_metadata.type"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 group, got %d", len(groups))
+	}
+	group := groups[0]
+	if group.GroupBy["project_id"] != "p1" || group.GroupBy["resource_metadata.type"] != "instance" {
+		t.Errorf("unexpected group %v", group.GroupBy)
+	}
+	if group.Count != 3 || group.Sum != 12 || group.Avg != 4 || group.Min != 1 || group.Max != 8 {
+		t.Errorf("unexpected statistics %+v", group)
+	}
+}
+
+// sampleValueType returns the type of the metric exported for a sample of the given type.
+func sampleValueType(t *testing.T, metric ceilometerMetric, sampleType string) prometheus.ValueType {
+	t.Helper()
+	sample := meters.OldSample{Type: sampleType, ResourceId: "r"}
+	var out dto.Metric
+	if err := sampleToMetric(&sample, metric.extractLabels(context.Background(), &sample), metric).Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case out.Counter != nil:
+		return prometheus.CounterValue
+	case out.Gauge != nil:
+		return prometheus.GaugeValue
+	}
+	return prometheus.UntypedValue
+}
+
+func TestGnocchiRateTypes(t *testing.T) {
+	definitions, _, err := loadMeterDefinitions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud := &openstackCloud{config: defaultConfig()}
+	cloud.config.Backend = backendGnocchi
+	cloud.config.definitions = map[string]MeterDefinition{
+		"cpu":    definitions["cpu"],
+		"memory": definitions["memory"],
+		"custom": {Metric: "custom", Type: "counter"},
+	}
+	cloud.config.Gnocchi.Aggregation = "rate:mean"
+	for name, metric := range cloud.metrics(MetricSelection{EnabledMetrics: []string{"*"}}) {
+		if valueType := sampleValueType(t, metric, ""); valueType != prometheus.GaugeValue {
+			t.Errorf("expected rates of %s to be gauges, got %v", name, valueType)
+		}
+	}
+
+	cloud.config.Gnocchi.Aggregation = "mean"
+	metrics := cloud.metrics(MetricSelection{EnabledMetrics: []string{"*"}})
+	expected := map[string]prometheus.ValueType{"cpu": prometheus.CounterValue, "memory": prometheus.GaugeValue, "custom": prometheus.CounterValue}
+	for name, valueType := range expected {
+		if actual := sampleValueType(t, metrics[name], ""); actual != valueType {
+			t.Errorf("expected %s to be %v, got %v", name, valueType, actual)
+		}
+	}
+}
+
+func TestCeilometerSampleTypes(t *testing.T) {
+	definitions, _, err := loadMeterDefinitions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud := &openstackCloud{config: defaultConfig()}
+	cloud.config.definitions = definitions
+	metric := cloud.metrics(MetricSelection{EnabledMetrics: []string{"cpu"}})["cpu"]
+	// The types of the built-in definitions do not replace those of Ceilometer samples
+	for sampleType, valueType := range map[string]prometheus.ValueType{"cumulative": prometheus.CounterValue, "gauge": prometheus.GaugeValue, "delta": prometheus.UntypedValue} {
+		if actual := sampleValueType(t, metric, sampleType); actual != valueType {
+			t.Errorf("expected a %s sample of cpu to be %v, got %v", sampleType, valueType, actual)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack"
+	"github.com/rackspace/gophercloud"
+	tokens3 "github.com/rackspace/gophercloud/openstack/identity/v3/tokens"
+)
+
+// Authentication methods, named as in clouds.yaml
+const (
+	authPassword              = "password"
+	authToken                 = "token"
+	authApplicationCredential = "v3applicationcredential"
+	authTokenEndpoint         = "token_endpoint"
+)
+
+var (
+	errTokenNotRenewable = errors.New("a pre-issued token cannot be renewed")
+	errTokenExpired      = errors.New("the configured token has expired")
+
+	identityVersionSuffix = regexp.MustCompile(`/v[0-9]+(\.[0-9]+)?/$`)
+)
+
+// The request bodies for identity v3 token creation, covering the methods and scopes not
+// supported by the vendored identity client.
+type v3AuthRequest struct {
+	Auth struct {
+		Identity v3Identity `json:"identity"`
+		Scope    *v3Scope   `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type v3Identity struct {
+	Methods               []string                 `json:"methods"`
+	Password              *v3Password              `json:"password,omitempty"`
+	Token                 *v3Token                 `json:"token,omitempty"`
+	ApplicationCredential *v3ApplicationCredential `json:"application_credential,omitempty"`
+}
+
+type v3Password struct {
+	User v3User `json:"user"`
+}
+
+type v3Token struct {
+	ID string `json:"id"`
+}
+
+type v3ApplicationCredential struct {
+	ID     string  `json:"id,omitempty"`
+	Name   string  `json:"name,omitempty"`
+	Secret string  `json:"secret"`
+	User   *v3User `json:"user,omitempty"`
+}
+
+type v3User struct {
+	ID       string    `json:"id,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Domain   *v3Domain `json:"domain,omitempty"`
+}
+
+type v3Domain struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type v3Scope struct {
+	Project *v3Project `json:"project,omitempty"`
+	Trust   *v3Trust   `json:"OS-TRUST:trust,omitempty"`
+}
+
+type v3Project struct {
+	ID     string    `json:"id,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Domain *v3Domain `json:"domain,omitempty"`
+}
+
+type v3Trust struct {
+	ID string `json:"id"`
+}
+
+func newV3Domain(id, name string) *v3Domain {
+	if id == "" && name == "" {
+		return nil
+	}
+	return &v3Domain{ID: id, Name: name}
+}
+
+func newV3User(auth *AuthConfig) *v3User {
+	user := &v3User{ID: auth.UserID, Password: auth.Password}
+	if auth.UserID == "" {
+		user.Name = auth.Username
+		user.Domain = newV3Domain(auth.userDomain())
+	}
+	return user
+}
+
+// authenticateV3 authenticates against identity v3 with the methods that the vendored client
+// does not handle: application credentials, trust scopes and users and projects in different
+// domains. On success, the token and catalog are installed on client.
+func authenticateV3(client *gophercloud.ProviderClient, auth *AuthConfig) (time.Time, error) {
+	// The auth URL may point to another version of the API, or to none
+	endpoint := identityVersionSuffix.ReplaceAllString(gophercloud.NormalizeURL(auth.AuthURL), "/") + "v3/"
+	identityClient := &gophercloud.ServiceClient{ProviderClient: client, Endpoint: endpoint}
+
+	var req v3AuthRequest
+	identity := &req.Auth.Identity
+	switch auth.method() {
+	case authApplicationCredential:
+		identity.Methods = []string{"application_credential"}
+		identity.ApplicationCredential = &v3ApplicationCredential{
+			ID:     auth.ApplicationCredentialID,
+			Name:   auth.ApplicationCredentialName,
+			Secret: auth.ApplicationCredentialSecret,
+		}
+		if auth.ApplicationCredentialID == "" {
+			identity.ApplicationCredential.User = newV3User(auth)
+		}
+	case authToken:
+		identity.Methods = []string{"token"}
+		identity.Token = &v3Token{ID: auth.Token}
+	default:
+		identity.Methods = []string{"password"}
+		identity.Password = &v3Password{User: *newV3User(auth)}
+	}
+
+	// Application credentials are always scoped to the project they were created in
+	if auth.TrustID != "" {
+		req.Auth.Scope = &v3Scope{Trust: &v3Trust{ID: auth.TrustID}}
+	} else if auth.method() != authApplicationCredential && auth.ProjectID != "" {
+		req.Auth.Scope = &v3Scope{Project: &v3Project{ID: auth.ProjectID}}
+	} else if auth.method() != authApplicationCredential && auth.ProjectName != "" {
+		req.Auth.Scope = &v3Scope{Project: &v3Project{
+			Name:   auth.ProjectName,
+			Domain: newV3Domain(auth.projectDomain()),
+		}}
+	}
+
+	var result tokens3.CreateResult
+	response, err := identityClient.Post(identityClient.ServiceURL("auth", "tokens"), req, &result.Body, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	tokenID := response.Header.Get("X-Subject-Token")
+	if tokenID == "" {
+		return time.Time{}, errors.New("no token in the response of Keystone")
+	}
+	expiresAt, err := tokenExpiry(result.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	catalog, err := result.ExtractServiceCatalog()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	client.TokenID = tokenID
+	client.EndpointLocator = func(opts gophercloud.EndpointOpts) (string, error) {
+		return openstack.V3EndpointURL(catalog, opts)
+	}
+	return expiresAt, nil
+}
+
+// tokenExpiry reads the expiry of a token created through identity v3, or v2 with its
+// access.token.expires. The vendored client requires it, but it may be left out, in which case
+// the zero time is returned and the token is only renewed once it is rejected.
+func tokenExpiry(body interface{}) (time.Time, error) {
+	response, _ := body.(map[string]interface{})
+	token, _ := response["token"].(map[string]interface{})
+	expiresAt, _ := token["expires_at"].(string)
+	if access, ok := response["access"].(map[string]interface{}); ok {
+		token, _ = access["token"].(map[string]interface{})
+		expiresAt, _ = token["expires"].(string)
+	}
+	if expiresAt == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, expiresAt)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+)
+
+func TestAuthenticateV3(t *testing.T) {
+	const catalog = `"catalog": [{"type": "metering", "endpoints": [{"interface": "public", "region": "R1", "url": "http://ceilometer/"}]}]`
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 123456000, time.UTC)
+
+	for _, test := range []struct {
+		name string
+		auth AuthConfig
+		// authURL is the path of the auth URL, /v3 unless given
+		authURL  string
+		status   int
+		token    string
+		response string
+		// request is the expected request body
+		request   string
+		expiresAt time.Time
+		err       bool
+	}{
+		{
+			name:      "application credential",
+			auth:      AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "s", ProjectName: "ignored"},
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "s"}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:      "application credential by name",
+			auth:      AuthConfig{ApplicationCredentialName: "ac", ApplicationCredentialSecret: "s", Username: "u", UserDomainName: "D"},
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"name": "ac", "secret": "s", "user": {"name": "u", "domain": {"name": "D"}}}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:      "trust",
+			auth:      AuthConfig{Username: "u", Password: "p", DomainID: "d", TrustID: "tr", ProjectName: "ignored"},
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "u", "password": "p", "domain": {"id": "d"}}}}, "scope": {"OS-TRUST:trust": {"id": "tr"}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:      "user and project in different domains",
+			auth:      AuthConfig{Username: "u", Password: "p", UserDomainName: "users", ProjectName: "x", ProjectDomainName: "projects"},
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "u", "password": "p", "domain": {"name": "users"}}}}, "scope": {"project": {"name": "x", "domain": {"name": "projects"}}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:      "token without expiry",
+			auth:      AuthConfig{Token: "old", ProjectID: "pid"},
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["token"], "token": {"id": "old"}}, "scope": {"project": {"id": "pid"}}}}`,
+			expiresAt: time.Time{},
+		},
+		{
+			name:      "identity v2 auth URL",
+			auth:      AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "s"},
+			authURL:   "/v2.0",
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "s"}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:      "unversioned auth URL",
+			auth:      AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "s"},
+			authURL:   "/",
+			status:    http.StatusCreated,
+			token:     "t1",
+			response:  `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:   `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "s"}}}}`,
+			expiresAt: expiry,
+		},
+		{
+			name:     "rejected",
+			auth:     AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "wrong"},
+			status:   http.StatusUnauthorized,
+			response: `{"error": {"code": 401, "message": "The request you have made requires authentication."}}`,
+			request:  `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "wrong"}}}}`,
+			err:      true,
+		},
+		{
+			name:     "missing token",
+			auth:     AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "s"},
+			status:   http.StatusCreated,
+			response: `{"token": {"expires_at": "2030-01-02T03:04:05.123456Z", ` + catalog + `}}`,
+			request:  `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "s"}}}}`,
+			err:      true,
+		},
+		{
+			name:     "invalid expiry",
+			auth:     AuthConfig{ApplicationCredentialID: "ac", ApplicationCredentialSecret: "s"},
+			status:   http.StatusCreated,
+			token:    "t1",
+			response: `{"token": {"expires_at": "tomorrow", ` + catalog + `}}`,
+			request:  `{"auth": {"identity": {"methods": ["application_credential"], "application_credential": {"id": "ac", "secret": "s"}}}}`,
+			err:      true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/v3/auth/tokens" {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL)
+				}
+				body, _ := ioutil.ReadAll(r.Body)
+				var request, expected interface{}
+				json.Unmarshal(body, &request)
+				json.Unmarshal([]byte(test.request), &expected)
+				if !reflect.DeepEqual(request, expected) {
+					t.Errorf("expected request %s, got %s", test.request, body)
+				}
+				if test.token != "" {
+					w.Header().Set("X-Subject-Token", test.token)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			client := &gophercloud.ProviderClient{}
+			test.auth.AuthURL = server.URL + "/v3"
+			if test.authURL != "" {
+				test.auth.AuthURL = server.URL + test.authURL
+			}
+			expiresAt, err := authenticateV3(client, &test.auth)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				if client.TokenID != "" {
+					t.Errorf("expected no token to be installed, got %q", client.TokenID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !expiresAt.Equal(test.expiresAt) {
+				t.Errorf("expected the token to expire at %v, got %v", test.expiresAt, expiresAt)
+			}
+			if client.TokenID != test.token {
+				t.Errorf("expected token %q, got %q", test.token, client.TokenID)
+			}
+			endpoint, err := client.EndpointLocator(gophercloud.EndpointOpts{Type: telemetryServiceType, Region: "R1", Availability: gophercloud.AvailabilityPublic})
+			if err != nil || endpoint != "http://ceilometer/" {
+				t.Errorf("expected the endpoint from the catalog, got %q, %v", endpoint, err)
+			}
+		})
+	}
+}
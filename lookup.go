@@ -0,0 +1,450 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack"
+	"github.com/rackspace/gophercloud"
+	"github.com/rackspace/gophercloud/openstack/compute/v2/servers"
+	"github.com/rackspace/gophercloud/openstack/networking/v2/extensions/lbaas/pools"
+	"github.com/rackspace/gophercloud/pagination"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const unknownName = "UNKNOWN"
+
+// lookupRetryInterval is how often services missing from the catalog are looked for again, if
+// the caches are not refreshed in the background.
+const lookupRetryInterval = 10 * time.Minute
+
+// LookupService resolves the ids found in samples to human readable names. It is used
+// concurrently by the scrapes of all meters. It is created once per cloud, and the lookups
+// against each service are set up once the service is found in the catalog.
+type LookupService struct {
+	mu           sync.RWMutex
+	config       LookupConfig
+	provider     *gophercloud.ProviderClient
+	endpointOpts gophercloud.EndpointOpts
+	// started is set once the background refresh is running
+	started bool
+
+	networkClient *gophercloud.ServiceClient
+	pools         *nameCache
+
+	serverClient *gophercloud.ServiceClient
+	instances    *nameCache
+}
+
+// connect sets up the lookups against the services found in the catalog of provider, and
+// starts refreshing the caches in the background. If compute or network is missing, lookups
+// against it are disabled rather than failing, and the service is looked for again on each
+// refresh.
+func (this *LookupService) connect(provider *gophercloud.ProviderClient, endpointOpts gophercloud.EndpointOpts, config LookupConfig) {
+	this.mu.Lock()
+	this.provider, this.endpointOpts, this.config = provider, endpointOpts, config
+	start := !this.started
+	this.started = true
+	this.mu.Unlock()
+
+	this.connectMissing(false)
+	if start {
+		go this.refreshLoop()
+	}
+}
+
+// connectMissing creates the caches of the services that have none yet, and populates them.
+// Failures are only logged at debug level when retrying.
+func (this *LookupService) connectMissing(retry bool) {
+	logf := log.Warnf
+	if retry {
+		logf = log.Debugf
+	}
+
+	this.mu.RLock()
+	provider, endpointOpts, config := this.provider, this.endpointOpts, this.config
+	missingNetwork, missingCompute := this.pools == nil, this.instances == nil
+	this.mu.RUnlock()
+
+	var added []*nameCache
+	if missingNetwork {
+		if networkClient, err := openstack.NewNetworkV2(provider, endpointOpts); err != nil {
+			logf("Disabling pool name lookups, network service not available: %v", err)
+		} else {
+			pools := newPoolCache(networkClient, config)
+			this.mu.Lock()
+			this.networkClient, this.pools = networkClient, pools
+			this.mu.Unlock()
+			added = append(added, pools)
+			log.Infof("Using network endpoint %s for pool name lookups", networkClient.Endpoint)
+		}
+	}
+	if missingCompute {
+		if serverClient, err := openstack.NewComputeV2(provider, endpointOpts); err != nil {
+			logf("Disabling instance name lookups, compute service not available: %v", err)
+		} else {
+			instances := newInstanceCache(serverClient, config)
+			this.mu.Lock()
+			this.serverClient, this.instances = serverClient, instances
+			this.mu.Unlock()
+			added = append(added, instances)
+			log.Infof("Using compute endpoint %s for instance name lookups", serverClient.Endpoint)
+		}
+	}
+
+	for _, cache := range added {
+		log.Debugf("Populating %s lookup cache", cache.kind)
+		if err := cache.refresh(); err != nil {
+			log.Warnf("Failed to populate %s name cache: %v", cache.kind, err)
+			continue
+		}
+		log.Debugf("Finished populating %s cache, %d names prepared.", cache.kind, cache.stats().entries)
+	}
+}
+
+func newPoolCache(networkClient *gophercloud.ServiceClient, config LookupConfig) *nameCache {
+	return newNameCache("pool", config, func(ctx context.Context, poolId string) (string, error) {
+		pool, err := pools.Get(withContext(ctx, networkClient), poolId).Extract()
+		if err != nil {
+			return "", err
+		}
+		if pool == nil {
+			return "", fmt.Errorf("pool %s not found", poolId)
+		}
+		return pool.Name, nil
+	}, func() (map[string]string, error) {
+		names := make(map[string]string)
+		err := pools.List(networkClient, pools.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+			poolList, err := pools.ExtractPools(page)
+			if err != nil {
+				return false, err
+			}
+			for _, pool := range poolList {
+				names[pool.ID] = pool.Name
+			}
+			return true, nil
+		})
+		return names, err
+	})
+}
+
+func newInstanceCache(serverClient *gophercloud.ServiceClient, config LookupConfig) *nameCache {
+	return newNameCache("instance", config, func(ctx context.Context, instanceId string) (string, error) {
+		instance, err := servers.Get(withContext(ctx, serverClient), instanceId).Extract()
+		if err != nil {
+			return "", err
+		}
+		if instance == nil {
+			return "", fmt.Errorf("instance %s not found", instanceId)
+		}
+		return instance.Name, nil
+	}, func() (map[string]string, error) {
+		names := make(map[string]string)
+		err := servers.List(serverClient, servers.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+			serverList, err := servers.ExtractServers(page)
+			if err != nil {
+				return false, err
+			}
+			for _, server := range serverList {
+				names[server.ID] = server.Name
+			}
+			return true, nil
+		})
+		return names, err
+	})
+}
+
+func (this *LookupService) lookupPool(ctx context.Context, poolId string) string {
+	this.mu.RLock()
+	pools := this.pools
+	this.mu.RUnlock()
+	if pools == nil {
+		return unknownName
+	}
+	return pools.get(ctx, poolId)
+}
+
+func (this *LookupService) lookupInstance(ctx context.Context, instanceId string) string {
+	this.mu.RLock()
+	instances := this.instances
+	this.mu.RUnlock()
+	if instances == nil {
+		return unknownName
+	}
+	return instances.get(ctx, instanceId)
+}
+
+// enabled reports whether lookups against the given service type are available.
+func (this *LookupService) enabled(serviceType string) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	switch serviceType {
+	case computeServiceType:
+		return this.instances != nil
+	case networkServiceType:
+		return this.pools != nil
+	}
+	return false
+}
+
+// missing returns the first of the service types for which lookups are disabled, if any.
+func (this *LookupService) missing(serviceTypes []string) (string, bool) {
+	for _, serviceType := range serviceTypes {
+		if !this.enabled(serviceType) {
+			return serviceType, true
+		}
+	}
+	return "", false
+}
+
+func (this *LookupService) caches() []*nameCache {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	var caches []*nameCache
+	for _, cache := range []*nameCache{this.pools, this.instances} {
+		if cache != nil {
+			caches = append(caches, cache)
+		}
+	}
+	return caches
+}
+
+func (this *LookupService) refresh() {
+	for _, cache := range this.caches() {
+		if err := cache.refresh(); err != nil {
+			log.Warnf("Failed to refresh %s name cache: %v", cache.kind, err)
+		}
+	}
+}
+
+// endpoints returns the endpoints of the services that lookups are made against.
+func (this *LookupService) endpoints() map[string]string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	endpoints := make(map[string]string)
+	if this.serverClient != nil {
+		endpoints[computeServiceType] = this.serverClient.Endpoint
+	}
+	if this.networkClient != nil {
+		endpoints[networkServiceType] = this.networkClient.Endpoint
+	}
+	return endpoints
+}
+
+// refreshLoop reloads the caches at the refresh interval, and looks for the missing services
+// again. It stops if the refresh is disabled and all services have been found.
+func (this *LookupService) refreshLoop() {
+	for {
+		this.mu.RLock()
+		interval := this.config.RefreshInterval
+		this.mu.RUnlock()
+		if interval > 0 {
+			time.Sleep(interval)
+			log.Debug("Refreshing guid lookup caches")
+			this.refresh()
+		} else if len(this.caches()) < 2 {
+			time.Sleep(lookupRetryInterval)
+		} else {
+			return
+		}
+		this.connectMissing(true)
+	}
+}
+
+// nameCache maps ids to names, calling fetch for ids that are not yet known or whose entry has
+// expired. Concurrent requests for the same missing id wait for a single call to fetch. Failed
+// lookups are cached as UNKNOWN for a shorter time than resolved names, except those stopped by
+// the deadline of the scrape, which are tried again by the next one.
+type nameCache struct {
+	kind   string
+	config LookupConfig
+	fetch  func(ctx context.Context, id string) (string, error)
+	list   func() (map[string]string, error)
+	now    func() time.Time
+
+	mu    sync.Mutex
+	names map[string]*nameCacheEntry
+	// expiry holds the entries of names ordered by expiry, for evicting the next to expire
+	expiry   expiryHeap
+	inflight map[string]*pendingLookup
+
+	hits, misses    int
+	refreshFailures int
+	refreshDuration time.Duration
+}
+
+type nameCacheEntry struct {
+	id, name string
+	expires  time.Time
+	// index is the position of the entry in the expiry heap
+	index int
+}
+
+// expiryHeap implements heap.Interface for cache entries, ordered by expiry.
+type expiryHeap []*nameCacheEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*nameCacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+type pendingLookup struct {
+	done chan struct{}
+	name string
+}
+
+type nameCacheStats struct {
+	entries         int
+	hits, misses    int
+	refreshFailures int
+	refreshDuration time.Duration
+}
+
+func newNameCache(kind string, config LookupConfig, fetch func(ctx context.Context, id string) (string, error), list func() (map[string]string, error)) *nameCache {
+	return &nameCache{
+		kind:     kind,
+		config:   config,
+		fetch:    fetch,
+		list:     list,
+		now:      time.Now,
+		names:    make(map[string]*nameCacheEntry),
+		inflight: make(map[string]*pendingLookup),
+	}
+}
+
+// get returns the name of id, or UNKNOWN if it cannot be resolved before ctx is done.
+func (c *nameCache) get(ctx context.Context, id string) string {
+	if id == "" {
+		return unknownName
+	}
+
+	c.mu.Lock()
+	if entry, ok := c.names[id]; ok && c.now().Before(entry.expires) {
+		c.hits++
+		name := entry.name
+		c.mu.Unlock()
+		return name
+	}
+	c.misses++
+	if pending, ok := c.inflight[id]; ok {
+		c.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.name
+		case <-ctx.Done():
+			return unknownName
+		}
+	}
+	pending := &pendingLookup{done: make(chan struct{})}
+	c.inflight[id] = pending
+	c.mu.Unlock()
+
+	name, err := c.fetch(ctx, id)
+	ttl, cached := c.config.TTL, true
+	if err != nil {
+		name = unknownName
+		ttl = c.config.NegativeTTL
+		if cached = ctx.Err() == nil; cached {
+			log.Warnf("Failure while looking up %s id %q", c.kind, id)
+		} else {
+			log.Debugf("Gave up looking up %s id %q: %v", c.kind, id, ctx.Err())
+		}
+	}
+
+	c.mu.Lock()
+	if cached {
+		c.store(id, name, ttl)
+	}
+	delete(c.inflight, id)
+	c.mu.Unlock()
+
+	pending.name = name
+	close(pending.done)
+	return name
+}
+
+// store adds or updates an entry, evicting expired entries and then those closest to expiry to
+// stay within MaxEntries. It must be called with mu held.
+func (c *nameCache) store(id, name string, ttl time.Duration) {
+	now := c.now()
+	if entry, ok := c.names[id]; ok {
+		entry.name, entry.expires = name, now.Add(ttl)
+		heap.Fix(&c.expiry, entry.index)
+		return
+	}
+	c.evictExpired(now)
+	for len(c.expiry) > 0 && len(c.expiry) >= c.config.MaxEntries {
+		c.evictNext()
+	}
+	entry := &nameCacheEntry{id: id, name: name, expires: now.Add(ttl)}
+	heap.Push(&c.expiry, entry)
+	c.names[id] = entry
+}
+
+func (c *nameCache) evictExpired(now time.Time) {
+	for len(c.expiry) > 0 && !now.Before(c.expiry[0].expires) {
+		c.evictNext()
+	}
+}
+
+// evictNext removes the entry closest to expiry.
+func (c *nameCache) evictNext() {
+	entry := heap.Pop(&c.expiry).(*nameCacheEntry)
+	delete(c.names, entry.id)
+}
+
+// refresh reloads all names from the list function. Entries that are no longer listed are
+// kept until they expire, since they may still be resolvable with fetch.
+func (c *nameCache) refresh() error {
+	if c.list == nil {
+		return nil
+	}
+	start := time.Now()
+	names, err := c.list()
+	duration := time.Since(start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshDuration = duration
+	if err != nil {
+		c.refreshFailures++
+		return err
+	}
+	c.evictExpired(c.now())
+	for id, name := range names {
+		c.store(id, name, c.config.TTL)
+	}
+	return nil
+}
+
+func (c *nameCache) stats() nameCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return nameCacheStats{
+		entries:         len(c.names),
+		hits:            c.hits,
+		misses:          c.misses,
+		refreshFailures: c.refreshFailures,
+		refreshDuration: c.refreshDuration,
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/rackspace/gophercloud"
+)
+
+// Run with -race to detect unsynchronized access to the caches.
+
+var testLookupConfig = LookupConfig{
+	TTL:         time.Hour,
+	NegativeTTL: time.Minute,
+	MaxEntries:  100,
+}
+
+// fakeClock is a settable replacement for time.Now
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func countingFetch(calls *int64, delay time.Duration) func(context.Context, string) (string, error) {
+	return func(ctx context.Context, id string) (string, error) {
+		atomic.AddInt64(calls, 1)
+		time.Sleep(delay)
+		if id == "missing" {
+			return "", errors.New("not found")
+		}
+		return "name-" + id, nil
+	}
+}
+
+func TestNameCacheDeduplicatesConcurrentMisses(t *testing.T) {
+	var calls int64
+	cache := newNameCache("test", testLookupConfig, countingFetch(&calls, 10*time.Millisecond), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if name := cache.get(context.Background(), "a"); name != "name-a" {
+				t.Errorf("expected name-a, got %q", name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected a single fetch, got %d", calls)
+	}
+}
+
+func TestNameCacheUnknown(t *testing.T) {
+	var calls int64
+	cache := newNameCache("test", testLookupConfig, countingFetch(&calls, 0), nil)
+
+	if name := cache.get(context.Background(), ""); name != unknownName {
+		t.Errorf("expected %q for empty id, got %q", unknownName, name)
+	}
+	if name := cache.get(context.Background(), "missing"); name != unknownName {
+		t.Errorf("expected %q for failed lookup, got %q", unknownName, name)
+	}
+	if calls != 1 {
+		t.Errorf("expected a single fetch, got %d", calls)
+	}
+}
+
+// set stores a name as a successful lookup of id would.
+func (c *nameCache) set(id, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(id, name, c.config.TTL)
+}
+
+func TestNameCacheSetDuringLookups(t *testing.T) {
+	var calls int64
+	cache := newNameCache("test", testLookupConfig, countingFetch(&calls, time.Millisecond), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		id := fmt.Sprintf("%d", i%5)
+		go func() {
+			defer wg.Done()
+			cache.get(context.Background(), id)
+		}()
+		go func() {
+			defer wg.Done()
+			cache.set(id, "name-"+id)
+			cache.stats()
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("%d", i)
+		if name := cache.get(context.Background(), id); name != "name-"+id {
+			t.Errorf("expected name-%s, got %q", id, name)
+		}
+	}
+}
+
+// TestLookupServiceParallelScrapes runs the label extraction of all meters that use the
+// lookup service concurrently, as Collect does.
+func TestLookupServiceParallelScrapes(t *testing.T) {
+	var poolCalls, instanceCalls int64
+	lookupSvc := LookupService{
+		pools:     newNameCache("pool", testLookupConfig, countingFetch(&poolCalls, time.Millisecond), nil),
+		instances: newNameCache("instance", testLookupConfig, countingFetch(&instanceCalls, time.Millisecond), nil),
+	}
+	definitions, _, err := loadMeterDefinitions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := *getMetrics(definitions, &lookupSvc, nil)
+
+	var wg sync.WaitGroup
+	for scrape := 0; scrape < 5; scrape++ {
+		for name, metric := range metrics {
+			wg.Add(1)
+			go func(name string, metric ceilometerMetric) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					id := fmt.Sprintf("%d", i%10)
+					sample := meters.OldSample{
+						Name:       name,
+						ResourceId: id,
+						ResourceMetadata: map[string]interface{}{
+							"instance_id": id,
+							"pool_id":     id,
+						},
+					}
+					metric.extractLabels(context.Background(), &sample)
+				}
+			}(name, metric)
+		}
+	}
+	wg.Wait()
+
+	if poolCalls > 10 {
+		t.Errorf("expected at most 10 pool lookups, got %d", poolCalls)
+	}
+	if instanceCalls > 10 {
+		t.Errorf("expected at most 10 instance lookups, got %d", instanceCalls)
+	}
+	if name := lookupSvc.lookupInstance(context.Background(), "3"); name != "name-3" {
+		t.Errorf("expected name-3, got %q", name)
+	}
+}
+
+func TestNameCacheDeadline(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	cache := newNameCache("test", testLookupConfig, func(ctx context.Context, id string) (string, error) {
+		atomic.AddInt64(&calls, 1)
+		select {
+		case <-release:
+			return "name-" + id, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}, nil)
+
+	// A lookup, and those waiting for it, stop at the deadline of their scrape
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if name := cache.get(ctx, "a"); name != unknownName {
+				t.Errorf("expected %s at the deadline, got %q", unknownName, name)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("expected a single lookup, got %d", calls)
+	}
+
+	// The lookup is not cached as failed, so the next scrape tries again
+	close(release)
+	if name := cache.get(context.Background(), "a"); name != "name-a" {
+		t.Errorf("expected name-a, got %q", name)
+	}
+	if calls != 2 {
+		t.Errorf("expected the lookup to be tried again, got %d lookups", calls)
+	}
+}
+
+func TestNameCacheExpiry(t *testing.T) {
+	var calls int64
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cache := newNameCache("test", testLookupConfig, countingFetch(&calls, 0), nil)
+	cache.now = clock.Now
+
+	cache.get(context.Background(), "a")
+	cache.get(context.Background(), "missing")
+	clock.Advance(2 * time.Minute)
+	cache.get(context.Background(), "a")
+	if calls != 2 {
+		t.Errorf("expected resolved name to be cached for the ttl, got %d fetches", calls)
+	}
+	cache.get(context.Background(), "missing")
+	if calls != 3 {
+		t.Errorf("expected failed lookup to expire after the negative ttl, got %d fetches", calls)
+	}
+	clock.Advance(time.Hour)
+	cache.get(context.Background(), "a")
+	if calls != 4 {
+		t.Errorf("expected resolved name to expire after the ttl, got %d fetches", calls)
+	}
+
+	stats := cache.stats()
+	if stats.hits != 1 || stats.misses != 4 {
+		t.Errorf("expected 1 hit and 4 misses, got %d and %d", stats.hits, stats.misses)
+	}
+}
+
+func TestNameCacheMaxEntries(t *testing.T) {
+	var calls int64
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config := testLookupConfig
+	config.MaxEntries = 3
+	cache := newNameCache("test", config, countingFetch(&calls, 0), nil)
+	cache.now = clock.Now
+
+	for i := 0; i < 5; i++ {
+		cache.get(context.Background(), fmt.Sprintf("%d", i))
+		clock.Advance(time.Second)
+	}
+	if entries := cache.stats().entries; entries != 3 {
+		t.Fatalf("expected 3 entries, got %d", entries)
+	}
+	// The oldest entries are evicted first
+	calls = 0
+	cache.get(context.Background(), "4")
+	cache.get(context.Background(), "0")
+	if calls != 1 {
+		t.Errorf("expected only the evicted entry to be fetched, got %d fetches", calls)
+	}
+
+	// Renewing an entry moves it back in the eviction order
+	cache.set("3", "renewed")
+	clock.Advance(time.Second)
+	cache.get(context.Background(), "5")
+	calls = 0
+	cache.get(context.Background(), "3")
+	cache.get(context.Background(), "4")
+	if calls != 1 {
+		t.Errorf("expected the renewed entry to be kept, got %d fetches", calls)
+	}
+}
+
+func TestNameCacheMaxEntriesRefresh(t *testing.T) {
+	config := testLookupConfig
+	config.MaxEntries = 100
+	listed := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		listed[fmt.Sprintf("%d", i)] = "name"
+	}
+	cache := newNameCache("test", config, nil, func() (map[string]string, error) {
+		return listed, nil
+	})
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := cache.stats().entries; entries != 100 || len(cache.expiry) != 100 {
+		t.Errorf("expected 100 entries, got %d and %d in the expiry order", entries, len(cache.expiry))
+	}
+	for i, entry := range cache.expiry {
+		if entry.index != i || cache.names[entry.id] != entry {
+			t.Fatalf("inconsistent expiry order at %d: %+v", i, entry)
+		}
+	}
+}
+
+func TestNameCacheRefresh(t *testing.T) {
+	var calls int64
+	listed := map[string]string{"a": "first"}
+	var listErr error
+	cache := newNameCache("test", testLookupConfig, countingFetch(&calls, 0), func() (map[string]string, error) {
+		return listed, listErr
+	})
+
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if name := cache.get(context.Background(), "a"); name != "first" {
+		t.Errorf("expected first, got %q", name)
+	}
+
+	listed = map[string]string{"a": "renamed"}
+	if err := cache.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if name := cache.get(context.Background(), "a"); name != "renamed" {
+		t.Errorf("expected renamed, got %q", name)
+	}
+
+	listErr = errors.New("unavailable")
+	if err := cache.refresh(); err == nil {
+		t.Error("expected refresh to fail")
+	}
+	if name := cache.get(context.Background(), "a"); name != "renamed" {
+		t.Errorf("expected entries to survive a failed refresh, got %q", name)
+	}
+	if failures := cache.stats().refreshFailures; failures != 1 {
+		t.Errorf("expected 1 refresh failure, got %d", failures)
+	}
+	if calls != 0 {
+		t.Errorf("expected no fetches, got %d", calls)
+	}
+}
+
+func TestLookupServiceDisabled(t *testing.T) {
+	var calls int64
+	lookupSvc := LookupService{
+		instances: newNameCache("instance", testLookupConfig, countingFetch(&calls, 0), nil),
+	}
+
+	if !lookupSvc.enabled(computeServiceType) || lookupSvc.enabled(networkServiceType) {
+		t.Errorf("expected only compute lookups to be enabled")
+	}
+	if name := lookupSvc.lookupPool(context.Background(), "a"); name != unknownName {
+		t.Errorf("expected %q from disabled lookup, got %q", unknownName, name)
+	}
+	if caches := lookupSvc.caches(); len(caches) != 1 {
+		t.Errorf("expected 1 cache, got %d", len(caches))
+	}
+}
+
+func TestLookupServiceConnect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2.0/lb/pools":
+			w.Write([]byte(`{"pools": [{"id": "p1", "name": "pool1"}]}`))
+		case "/servers/detail":
+			w.Write([]byte(`{"servers": [{"id": "i1", "name": "vm1"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var computeAvailable int32
+	provider := &gophercloud.ProviderClient{
+		EndpointLocator: func(opts gophercloud.EndpointOpts) (string, error) {
+			if opts.Type == computeServiceType && atomic.LoadInt32(&computeAvailable) == 0 {
+				return "", gophercloud.ErrEndpointNotFound
+			}
+			return server.URL + "/", nil
+		},
+	}
+
+	var lookupSvc LookupService
+	lookupSvc.connect(provider, gophercloud.EndpointOpts{}, testLookupConfig)
+	if !lookupSvc.enabled(networkServiceType) || lookupSvc.enabled(computeServiceType) {
+		t.Fatalf("expected only network lookups to be enabled")
+	}
+	if name := lookupSvc.lookupPool(context.Background(), "p1"); name != "pool1" {
+		t.Errorf("expected the pool cache to be populated, got %q", name)
+	}
+	pools := lookupSvc.caches()[0]
+
+	// Compute appears in the catalog later, and the existing cache is kept
+	atomic.StoreInt32(&computeAvailable, 1)
+	lookupSvc.connectMissing(true)
+	lookupSvc.connect(provider, gophercloud.EndpointOpts{}, testLookupConfig)
+	caches := lookupSvc.caches()
+	if len(caches) != 2 || caches[0] != pools {
+		t.Errorf("expected the pool cache to be kept and an instance cache added, got %v", caches)
+	}
+	if name := lookupSvc.lookupInstance(context.Background(), "i1"); name != "vm1" {
+		t.Errorf("expected the instance cache to be populated, got %q", name)
+	}
+	if endpoints := lookupSvc.endpoints(); len(endpoints) != 2 || endpoints[computeServiceType] != server.URL+"/" {
+		t.Errorf("unexpected endpoints %v", endpoints)
+	}
+}
@@ -1,99 +1,138 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"sort"
-	"strings"
+	"strconv"
 	"time"
 
-	"github.com/DSpeichert/gophercloud/openstack"
-	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
-	"github.com/rackspace/gophercloud"
-	"github.com/rackspace/gophercloud/openstack/compute/v2/servers"
-	"github.com/rackspace/gophercloud/openstack/networking/v2/extensions/lbaas/pools"
-	"github.com/rackspace/gophercloud/pagination"
-
 	"github.com/prometheus/client_golang/prometheus"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/ryanuber/go-glob"
 )
 
 /*
   TODOs:
-  - Auth without env?
   - Split metric types (HW/Resources/...) (?)
-  - Support for meter/foo/statistics for some types?
-  - Multiple scrapers
-  - Split to multiple files
   - Calculated metrics (eg count of rules in firewall policy)
-  - Timeout?
 */
 
-func init() {
-	flag.Parse()
-
-	parsedLevel, err := log.ParseLevel(*rawLevel)
-	if err != nil {
-		log.Fatal(err)
-	}
-	logLevel = parsedLevel
-
-	enabledMetrics = strings.Split(*rawEnabledMetrics, ",")
-	disabledMetrics = strings.Split(*rawDisabledMetrics, ",")
-}
-
 const (
 	namespace             = "openstack_ceilometer"
 	defaultEnabledMetrics = "*"
+	telemetryServiceType  = "metering"
+	metricServiceType     = "metric"
+	alarmingServiceType   = "alarming"
+	eventServiceType      = "event"
+	computeServiceType    = "compute"
+	networkServiceType    = "network"
 )
 
 var (
-	logLevel           = log.InfoLevel
-	rawLevel           = flag.String("log-level", "info", "log level")
-	bindAddr           = flag.String("bind-addr", ":9181", "bind address for the metrics server")
-	metricsPath        = flag.String("metrics-path", "/metrics", "path to metrics endpoint")
-	maxResults         = flag.Int("max-results", 100, "maximum number of results to fetch for any metric")
-	maxMetricAge       = flag.Duration("max-metric-age", 5*time.Minute, "maximum age of metrics to retrieve")
-	enabledMetrics     []string
-	rawEnabledMetrics  = flag.String("enabled-metrics", defaultEnabledMetrics, "comma-separated list of metrics to enable (supports globbing)")
-	disabledMetrics    []string
-	rawDisabledMetrics = flag.String("disabled-metrics", "", "comma-separated list of metrics to disable (supports globbing)")
-	listMetrics        = flag.Bool("list-metrics", false, "show list of metrics and exit")
+	config                *Config
+	clouds                = make(map[string]*openstackCloud)
+	configFile            = flag.String("config.file", "", "path to configuration file")
+	osCloud               = flag.String("os-cloud", "", "name of the cloud in clouds.yaml to use (defaults to $OS_CLOUD)")
+	osRegion              = flag.String("os-region", "", "region to use endpoints from (defaults to $OS_REGION_NAME)")
+	osInterface           = flag.String("os-interface", "", "endpoint interface to use, one of public, internal or admin (defaults to $OS_INTERFACE)")
+	rawEndpoints          = flag.String("endpoint-overrides", "", "comma-separated list of service-type=URL pairs to use instead of the catalog")
+	rawLevel              = flag.String("log-level", "info", "log level")
+	bindAddr              = flag.String("bind-addr", ":9181", "bind address for the metrics server")
+	metricsPath           = flag.String("metrics-path", "/metrics", "path to metrics endpoint")
+	probePath             = flag.String("probe-path", "/probe", "path to multi-target probe endpoint")
+	backend               = flag.String("backend", backendCeilometer, "service to read meters from, ceilometer or gnocchi")
+	meterDefinitions      = flag.String("meter-definitions", "", "path to a file of meter definitions, merged with the built-in ones")
+	maxResults            = flag.Int("max-results", 100, "maximum number of samples to fetch per request")
+	maxSamples            = flag.Int("max-samples", 10000, "maximum number of samples to fetch for any metric in one scrape")
+	maxMetricAge          = flag.Duration("max-metric-age", 5*time.Minute, "maximum age of metrics to retrieve")
+	scrapeTimeout         = flag.Duration("scrape-timeout", 0, "maximum duration of a scrape, if Prometheus does not announce a shorter timeout (0 for none)")
+	scrapeTimeoutOffset   = flag.Duration("scrape-timeout-offset", 500*time.Millisecond, "time subtracted from the scrape timeout announced by Prometheus")
+	pollInterval          = flag.Duration("poll-interval", 0, "scrape meters in the background at this interval and serve the latest results (0 to scrape on request)")
+	pollJitter            = flag.Duration("poll-jitter", 0, "maximum random delay of each background poll into its interval")
+	sampleTimestamps      = flag.Bool("sample-timestamps", false, "export metrics with the timestamps of the samples rather than the scrape time")
+	rawEnabledMetrics     = flag.String("enabled-metrics", defaultEnabledMetrics, "comma-separated list of metrics to enable (supports globbing)")
+	rawDisabledMetrics    = flag.String("disabled-metrics", "", "comma-separated list of metrics to disable (supports globbing)")
+	listMetrics           = flag.Bool("list-metrics", false, "show list of metrics and exit")
+	lookupRefreshInterval = flag.Duration("lookup-refresh-interval", 10*time.Minute, "how often to reload the instance and pool name caches (0 to disable)")
+	lookupTTL             = flag.Duration("lookup-ttl", time.Hour, "how long a resolved instance or pool name is cached")
+	lookupNegativeTTL     = flag.Duration("lookup-negative-ttl", 5*time.Minute, "how long a failed instance or pool name lookup is cached")
+	lookupMaxEntries      = flag.Int("lookup-max-entries", 10000, "maximum number of names held in each lookup cache")
+	tokenRefreshMargin    = flag.Duration("token-refresh-margin", 5*time.Minute, "re-authenticate this long before the Keystone token expires")
 )
 
-func shouldUseMetric(metric string) bool {
-	for _, enabled := range enabledMetrics {
-		if glob.Glob(enabled, metric) {
-			for _, disabled := range disabledMetrics {
-				if glob.Glob(disabled, metric) {
-					return false
-				}
-			}
-			return true
-		}
-	}
-	return false
-}
-
 func main() {
+	flag.Parse()
+
+	logLevel, err := log.ParseLevel(*rawLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.SetLevel(logLevel)
+
+	config, err = loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *listMetrics {
 		displayMetricsList()
 		return
 	}
+	if err := config.validateAuth(); err != nil {
+		log.Fatal(err)
+	}
 
-	prometheus.MustRegister(NewCeilometerCollector())
+	registry := newMetricRegistry()
+	collectors := []prometheus.Collector{prometheus.NewProcessCollector(os.Getpid(), ""), prometheus.NewGoCollector()}
+	for _, target := range config.targets {
+		cloud := NewOpenstackCloud(target)
+		clouds[target.Name] = cloud
+		selections := []MetricSelection{target.MetricSelection}
+		for _, module := range config.Modules {
+			selections = append(selections, module)
+		}
+		cloud.startPolling(selections)
+		if target.Discovery.Enabled {
+			cloud.startDiscovery()
+		}
+		for _, selection := range selections {
+			if selection.shouldUseMetric(eventsMetric) {
+				if cloud.events, err = newEventCounter(target); err != nil {
+					log.Fatal(err)
+				}
+				break
+			}
+		}
+		collectors = append(collectors, NewCeilometerCollector(cloud, target.MetricSelection))
+		if target.shouldUseMetric(alarmsMetric) {
+			collectors = append(collectors, NewAlarmCollector(cloud))
+		}
+		if target.shouldUseMetric(eventsMetric) {
+			collectors = append(collectors, NewEventCollector(cloud))
+		}
+		if target.shouldUseMetric(resourcesMetric) {
+			collectors = append(collectors, NewResourceCollector(cloud))
+		}
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	http.Handle(*metricsPath, withScrapeTimeout(registry))
+	http.Handle(*probePath, withScrapeTimeout(http.HandlerFunc(probeHandler)))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>Openstack Ceilometer Exporter</title></head>
              <body>
              <h1>Openstack Ceilometer Exporter</h1>
              <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             <p>Probe individual clouds with <code>` + *probePath + `?target=&lt;cloud&gt;&amp;module=&lt;module&gt;</code></p>
              </body>
              </html>`))
 	})
@@ -102,11 +141,12 @@ func main() {
 }
 
 func displayMetricsList() {
-	metrics := *getMetrics(nil)
-	availableMetrics := make([]string, 0, len(metrics))
+	metrics := config.definitions
+	availableMetrics := make([]string, 0, len(metrics)+3)
 	for name, _ := range metrics {
 		availableMetrics = append(availableMetrics, name)
 	}
+	availableMetrics = append(availableMetrics, alarmsMetric, eventsMetric, resourcesMetric)
 	sort.Strings(availableMetrics)
 
 	for _, metric := range availableMetrics {
@@ -114,273 +154,71 @@ func displayMetricsList() {
 	}
 }
 
-type LookupService struct {
-	poolNameCache map[string]string
-	networkClient *gophercloud.ServiceClient
-
-	instanceNameCache map[string]string
-	serverClient      *gophercloud.ServiceClient
-}
-
-func NewLookupService(provider *gophercloud.ProviderClient) LookupService {
-	networkClient, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{})
-	if err != nil {
-		panic(err)
-	}
-
-	serverClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{})
-	if err != nil {
-		panic(err)
-	}
-
-	log.Debug("Populating guid lookup caches")
-
-	poolNameCache := make(map[string]string)
-	poolPager := pools.List(networkClient, pools.ListOpts{})
-	poolPager.EachPage(func(page pagination.Page) (bool, error) {
-		poolList, err := pools.ExtractPools(page)
-		if err != nil {
-			return false, err
-		}
-		for _, pool := range poolList {
-			poolNameCache[pool.ID] = pool.Name
-		}
-		return true, nil
-	})
-
-	serverNameCache := make(map[string]string)
-	serverPager := servers.List(serverClient, servers.ListOpts{})
-	serverPager.EachPage(func(page pagination.Page) (bool, error) {
-		serverList, err := servers.ExtractServers(page)
-		if err != nil {
-			return false, err
+// withScrapeTimeout sets a deadline on requests, from the timeout announced by Prometheus in
+// the X-Prometheus-Scrape-Timeout-Seconds header or the configured scrape timeout, whichever
+// is shorter. Collectors stop scraping when it is reached.
+func withScrapeTimeout(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := config.ScrapeTimeout
+		if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+			seconds, err := strconv.ParseFloat(header, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid scrape timeout %q: %v", header, err), http.StatusBadRequest)
+				return
+			}
+			announced := time.Duration(seconds*float64(time.Second)) - config.ScrapeTimeoutOffset
+			if announced <= 0 {
+				announced = time.Duration(seconds * float64(time.Second))
+			}
+			if timeout == 0 || announced < timeout {
+				timeout = announced
+			}
 		}
-		for _, server := range serverList {
-			serverNameCache[server.ID] = server.Name
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
 		}
-		return true, nil
+		handler.ServeHTTP(w, r)
 	})
-
-	log.Debugf("Finished populating caches. %d pools and %d instances prepared.", len(poolNameCache), len(serverNameCache))
-
-	return LookupService{
-		networkClient:     networkClient,
-		poolNameCache:     poolNameCache,
-		serverClient:      serverClient,
-		instanceNameCache: serverNameCache,
-	}
-}
-
-func (this *LookupService) lookupPool(poolId string) string {
-	if poolId == "" {
-		return "UNKNOWN"
-	}
-
-	var name string
-	if name, ok := this.poolNameCache[poolId]; ok {
-		return name
-	}
-
-	result := pools.Get(this.networkClient, poolId)
-	pool, err := result.Extract()
-	if err != nil {
-		log.Warnf("Failure while looking up pool id %q", poolId)
-		name = "UNKNOWN"
-	} else {
-		name = pool.Name
-	}
-	this.poolNameCache[poolId] = name
-	return name
-}
-
-func (this *LookupService) lookupInstance(instanceId string) string {
-	if instanceId == "" {
-		return "UNKNOWN"
-	}
-
-	var name string
-	if name, ok := this.instanceNameCache[instanceId]; ok {
-		return name
-	}
-
-	result := servers.Get(this.serverClient, instanceId)
-	instance, err := result.Extract()
-	if err != nil {
-		log.Warnf("Failure while looking up instance id %q", instanceId)
-		name = "UNKNOWN"
-	} else {
-		name = instance.Name
-	}
-	this.instanceNameCache[instanceId] = name
-	return name
 }
 
-func makeFQName(metric string) string {
-	return fmt.Sprintf("%s_%s", namespace, metric)
-}
-
-func NewCeilometerCollector() *ceilometerCollector {
-	opts, err := openstack.AuthOptionsFromEnv()
-	if err != nil {
-		panic(err)
-	}
-	provider, err := openstack.AuthenticatedClient(opts)
-	if err != nil {
-		panic(err)
-	}
-
-	client, err := openstack.NewTelemetryV2(provider, gophercloud.EndpointOpts{})
-	if err != nil {
-		panic(err)
+// probeHandler serves the metrics of a single cloud, restricted to the metrics of a module if
+// one is given, allowing Prometheus to select what is scraped through relabeling.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	cloud, ok := clouds[target]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown target %q", target), http.StatusBadRequest)
+		return
 	}
 
-	lookupSvc := NewLookupService(provider)
-
-	allMetrics := *getMetrics(&lookupSvc)
-	filteredMetrics := make(map[string]ceilometerMetric)
-	for name, metric := range allMetrics {
-		if shouldUseMetric(name) {
-			filteredMetrics[name] = metric
+	selection := cloud.config.MetricSelection
+	if moduleName := r.URL.Query().Get("module"); moduleName != "" {
+		module, ok := config.Modules[moduleName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+			return
 		}
+		selection = module
 	}
 
-	return &ceilometerCollector{
-		metrics: filteredMetrics,
-		metaMetrics: map[string]*prometheus.Desc{
-			"scrapeSuccess":    prometheus.NewDesc(makeFQName("metric_scrape_success"), "Indicates if the metric was successfully scraped", []string{"metric"}, nil),
-			"scrapeDuration":   prometheus.NewDesc(makeFQName("metric_scrape_duration_ns"), "The time taken to scrape the metric", []string{"metric"}, nil),
-			"scrapeResultSize": prometheus.NewDesc(makeFQName("metric_scrape_result_size"), "Number of results returned by the metric query", []string{"metric"}, nil),
-
-			"totalScrapeDuration": prometheus.NewDesc(makeFQName("total_scrape_duration_ns"), "Time taken for entire scrape", nil, nil),
-		},
-		client: client,
-	}
-}
-
-type ceilometerCollector struct {
-	client      *gophercloud.ServiceClient
-	metrics     map[string]ceilometerMetric
-	metaMetrics map[string]*prometheus.Desc
-}
-type ceilometerMetric struct {
-	desc          *prometheus.Desc
-	extractLabels func(*meters.OldSample) []string
-}
-
-func (c *ceilometerCollector) Describe(ch chan<- *prometheus.Desc) {
-	log.Debugf("Sending %d metrics descriptions", len(c.metrics)+len(c.metaMetrics))
-	for _, metric := range c.metrics {
-		ch <- metric.desc
-	}
-	for _, metric := range c.metaMetrics {
-		ch <- metric
-	}
-}
-
-func (c *ceilometerCollector) Collect(ch chan<- prometheus.Metric) {
-	t := time.Now()
-	result := make(chan scrapeStats)
-	defer close(result)
-	for resourceLabel, metric := range c.metrics {
-		go scrape(resourceLabel, metric, c.client, ch, result)
+	registry := newMetricRegistry()
+	collectors := []prometheus.Collector{NewCeilometerCollector(cloud, selection)}
+	if selection.shouldUseMetric(alarmsMetric) {
+		collectors = append(collectors, NewAlarmCollector(cloud))
 	}
-	for _ = range c.metrics {
-		scrapeStats := <-result
-		ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeSuccess"], prometheus.GaugeValue, btof(scrapeStats.success), scrapeStats.resourceLabel)
-		ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeDuration"], prometheus.GaugeValue, float64(scrapeStats.duration.Nanoseconds()), scrapeStats.resourceLabel)
-		ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeResultSize"], prometheus.GaugeValue, float64(scrapeStats.resultSize), scrapeStats.resourceLabel)
-	}
-
-	ch <- prometheus.MustNewConstMetric(c.metaMetrics["totalScrapeDuration"], prometheus.GaugeValue, float64(time.Since(t).Nanoseconds()))
-}
-
-func btof(b bool) float64 {
-	if b {
-		return 1.0
-	} else {
-		return 0.0
+	if selection.shouldUseMetric(eventsMetric) {
+		collectors = append(collectors, NewEventCollector(cloud))
 	}
-}
-
-type scrapeStats struct {
-	resourceLabel string
-	success       bool
-	duration      time.Duration
-	resultSize    int
-}
-
-func sendStats(ch chan<- scrapeStats, stats *scrapeStats) {
-	ch <- *stats
-}
-func registerDuration(start time.Time, stats *scrapeStats) {
-	stats.duration = time.Since(start)
-}
-
-func scrape(resourceLabel string, metric ceilometerMetric, client *gophercloud.ServiceClient, ch chan<- prometheus.Metric, result chan<- scrapeStats) {
-	t := time.Now()
-	stats := scrapeStats{resourceLabel: resourceLabel}
-	defer sendStats(result, &stats)
-	defer registerDuration(t, &stats)
-
-	query := meters.ShowOpts{
-		QueryField: "timestamp",
-		QueryOp:    "gt",
-		QueryValue: time.Now().UTC().Add(-*maxMetricAge).Format("2006-01-02T15:04:05"),
-		Limit:      *maxResults,
+	if selection.shouldUseMetric(resourcesMetric) {
+		collectors = append(collectors, NewResourceCollector(cloud))
 	}
-	log.Debugf("Querying for %v: %v", resourceLabel, query)
-	results := meters.Show(client, resourceLabel, query)
-	data, err := results.Extract()
-	if err != nil {
-		log.Warnf("Failed to scrape Ceilometer resource %q", resourceLabel)
-		return
-	}
-	if len(data) == 0 {
-		log.Warnf("Query for %v returned no results!", resourceLabel)
-		stats.success = true // The query itself was successful, even though no results were produced
-		return
-	}
-	if len(data) == *maxResults {
-		log.Warnf("Query for %v returned max number of results (%d), data may be truncated", resourceLabel, *maxResults)
-	}
-	initialLen := len(data)
-	data = deduplicate(data)
-	log.Debugf("Query for %s returned %d results, %d remain after deduplication", resourceLabel, initialLen, len(data))
-	stats.resultSize = len(data)
-
-	for _, sample := range data {
-		ch <- sampleToMetric(&sample, metric)
-	}
-
-	stats.success = true
-}
-
-func deduplicate(samples []meters.OldSample) []meters.OldSample {
-	unique := make([]meters.OldSample, 0, len(samples))
-	seen := make(map[string]bool)
-	for _, sample := range samples {
-		if _, ok := seen[sample.ResourceId]; !ok {
-			seen[sample.ResourceId] = true
-			unique = append(unique, sample)
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
-	return unique
-}
-
-func sampleToMetric(sample *meters.OldSample, metric ceilometerMetric) prometheus.Metric {
-	var valueType prometheus.ValueType
-	switch sample.Type {
-	case "gauge":
-		valueType = prometheus.GaugeValue
-	case "cumulative":
-		valueType = prometheus.CounterValue
-
-	default:
-		log.Debugf("Unknown sample type %v in query for %v", sample.Type, sample.Name)
-		valueType = prometheus.UntypedValue
-	}
-
-	value := float64(sample.Volume)
-
-	return prometheus.MustNewConstMetric(metric.desc, valueType, value, metric.extractLabels(sample)...)
+	registry.ServeHTTP(w, r)
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rackspace/gophercloud"
+)
+
+// newProbeCloud creates a connected cloud named name, with a single cpu meter served by its own
+// server. Requests to the server are counted in requests.
+func newProbeCloud(t *testing.T, name string, requests *int32) *openstackCloud {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		fmt.Fprintf(w, `[{"counter_name": "cpu", "counter_type": "cumulative", "counter_volume": 1, "message_id": "m1",
+			"resource_id": "%s-instance", "resource_metadata": {}, "timestamp": %q}]`, name, time.Now().UTC().Format(timestampFormat))
+	}))
+	t.Cleanup(server.Close)
+
+	target := defaultConfig()
+	target.Name = name
+	target.EnabledMetrics = []string{"cpu", "memory"}
+	target.definitions = map[string]MeterDefinition{
+		"cpu":    {Metric: "cpu", Help: "CPU time", Labels: []LabelDefinition{{Name: "resource_id", From: "resource_id"}}},
+		"memory": {Metric: "memory", Help: "Memory", Labels: []LabelDefinition{{Name: "resource_id", From: "resource_id"}}},
+	}
+	return &openstackCloud{
+		config:    target,
+		connected: true,
+		session:   &keystoneSession{},
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+}
+
+// withProbeClouds replaces the configuration and clouds served by the probe handler for the
+// duration of a test.
+func withProbeClouds(t *testing.T, modules map[string]MetricSelection, targets ...*openstackCloud) {
+	t.Helper()
+	previousConfig, previousClouds := config, clouds
+	t.Cleanup(func() { config, clouds = previousConfig, previousClouds })
+
+	config = defaultConfig()
+	config.Modules = modules
+	clouds = make(map[string]*openstackCloud)
+	for _, cloud := range targets {
+		clouds[cloud.config.Name] = cloud
+	}
+}
+
+func probe(query string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	probeHandler(recorder, httptest.NewRequest("GET", "/probe?"+query, nil))
+	return recorder
+}
+
+func TestProbeHandlerErrors(t *testing.T) {
+	var requests int32
+	withProbeClouds(t, map[string]MetricSelection{"cpu": {EnabledMetrics: []string{"cpu"}}}, newProbeCloud(t, "a", &requests))
+
+	for query, expected := range map[string]string{
+		"":                     `Unknown target ""`,
+		"target=b":             `Unknown target "b"`,
+		"target=a&module=disk": `Unknown module "disk"`,
+	} {
+		response := probe(query)
+		if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), expected) {
+			t.Errorf("expected %q for query %q, got %d: %s", expected, query, response.Code, response.Body)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests for invalid probes, got %d", requests)
+	}
+}
+
+func TestProbeHandlerIsolation(t *testing.T) {
+	var requestsA, requestsB int32
+	withProbeClouds(t, map[string]MetricSelection{"cpu": {EnabledMetrics: []string{"cpu"}}},
+		newProbeCloud(t, "a", &requestsA), newProbeCloud(t, "b", &requestsB))
+
+	response := probe("target=a")
+	body := response.Body.String()
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected the probe to succeed, got %d: %s", response.Code, body)
+	}
+	if !strings.Contains(body, `resource_id="a-instance"`) || strings.Contains(body, `cloud="b"`) {
+		t.Errorf("expected only the metrics of cloud a, got %s", body)
+	}
+	if atomic.LoadInt32(&requestsA) != 2 || atomic.LoadInt32(&requestsB) != 0 {
+		t.Errorf("expected only cloud a to be scraped, got %d and %d requests", requestsA, requestsB)
+	}
+
+	// The module restricts the meters scraped
+	response = probe("target=b&module=cpu")
+	if body := response.Body.String(); !strings.Contains(body, `resource_id="b-instance"`) || strings.Contains(body, `cloud="a"`) {
+		t.Errorf("expected only the metrics of cloud b, got %s", body)
+	}
+	if atomic.LoadInt32(&requestsB) != 1 {
+		t.Errorf("expected only the cpu meter of cloud b to be scraped, got %d requests", requestsB)
+	}
+
+	// Concurrent probes of different clouds do not share their collectors
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			response := probe("target=" + target)
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `resource_id="`+target+`-instance"`) {
+				t.Errorf("unexpected response for cloud %s: %d: %s", target, response.Code, response.Body)
+			}
+		}([]string{"a", "b"}[i%2])
+	}
+	wg.Wait()
+}
+
+func TestProbeHandlerKeepsTimestamps(t *testing.T) {
+	var requests int32
+	cloud := newProbeCloud(t, "a", &requests)
+	cloud.config.SampleTimestamps = true
+	withProbeClouds(t, nil, cloud)
+
+	// Each probe builds its own collector, which must not forget the exported sample times
+	for i := 0; i < 2; i++ {
+		if response := probe("target=a"); response.Code != http.StatusOK {
+			t.Fatalf("expected the probe to succeed, got %d: %s", response.Code, response.Body)
+		}
+	}
+	first := NewCeilometerCollector(cloud, cloud.config.MetricSelection).metrics["cpu"].timestamps
+	second := NewCeilometerCollector(cloud, cloud.config.MetricSelection).metrics["cpu"].timestamps
+	if first == nil || first != second {
+		t.Fatalf("expected the collectors to share the sample times of the cloud")
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if _, ok := first.last["a-instance"]; !ok || len(first.last) != 1 {
+		t.Errorf("expected the sample time exported by the probes to be kept, got %v", first.last)
+	}
+}
@@ -1,279 +1,559 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"gopkg.in/yaml.v3"
 )
 
-func getMetrics(lookupSvc *LookupService) *map[string]ceilometerMetric {
-	return &map[string]ceilometerMetric{
-		// Hardware metrics
-		"cpu": {
-			desc: prometheus.NewDesc(makeFQName("cpu_nanoseconds"), "Consumed CPU time (nanoseconds)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"cpu_util": {
-			desc: prometheus.NewDesc(makeFQName("cpu_percent"), "CPU utilization (percent)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"disk.allocation": {
-			desc: prometheus.NewDesc(makeFQName("disk_allocation"), "Disk allocation", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"disk.capacity": {
-			desc: prometheus.NewDesc(makeFQName("disk_capacity"), "Disk capacity", []string{"instance_id", "instance_name", "device"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["device"],
-				}
-			},
-		},
-		"disk.ephemeral.size": {
-			desc: prometheus.NewDesc(makeFQName("disk_ephemeral_size"), "Size of ephemeral disk  ", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"disk.read.bytes": {
-			desc: prometheus.NewDesc(makeFQName("disk_read_bytes"), "Disk bytes read", []string{"instance_id", "instance_name", "device"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["device"],
-				}
-			},
-		},
-		"disk.read.requests": {
-			desc: prometheus.NewDesc(makeFQName("disk_read_requests"), "Disk read requests", []string{"instance_id", "instance_name", "device"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["device"],
-				}
-			},
-		},
-		"disk.root.size": {
-			desc: prometheus.NewDesc(makeFQName("disk_root_size"), "Root disk size", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"disk.usage": {
-			desc: prometheus.NewDesc(makeFQName("disk_usage"), "Disk usage", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"disk.write.bytes": {
-			desc: prometheus.NewDesc(makeFQName("disk_write_bytes"), "Disk written bytes", []string{"instance_id", "instance_name", "device"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["device"],
-				}
-			},
-		},
-		"disk.write.requests": {
-			desc: prometheus.NewDesc(makeFQName("disk_write_requests"), "Disk write requests", []string{"instance_id", "instance_name", "device"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["device"],
-				}
-			},
-		},
+// The built-in meters, shipped as a definition file in the same format as those given with
+// -meter-definitions.
+//
+//go:embed default-meters.yml
+var defaultMeterDefinitionsFile []byte
 
-		"memory.usage": {
-			desc: prometheus.NewDesc(makeFQName("memory_usage"), "Memory utilization", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"memory": {
-			desc: prometheus.NewDesc(makeFQName("memory"), "Memory allocation", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"memory.resident": {
-			desc: prometheus.NewDesc(makeFQName("memory_resident"), "Resident memory utilization", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-				}
-			},
-		},
-		"network.incoming.bytes": {
-			desc: prometheus.NewDesc(makeFQName("incoming_bytes"), "Instance incoming network (bytes)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["instance_id"],
-					lookupSvc.lookupInstance(sample.ResourceMetadata["instance_id"]),
-				}
-			},
-		},
-		"network.incoming.packets": {
-			desc: prometheus.NewDesc(makeFQName("incoming_packets"), "Instance incoming network (packets)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["instance_id"],
-					lookupSvc.lookupInstance(sample.ResourceMetadata["instance_id"]),
-				}
-			},
-		},
-		"network.outgoing.bytes": {
-			desc: prometheus.NewDesc(makeFQName("outgoing_bytes"), "Instance outgoing network (bytes)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["instance_id"],
-					lookupSvc.lookupInstance(sample.ResourceMetadata["instance_id"]),
-				}
-			},
-		},
-		"network.outgoing.packets": {
-			desc: prometheus.NewDesc(makeFQName("outgoing_packets"), "Instance outgoing network (packets)", []string{"instance_id", "instance_name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["instance_id"],
-					lookupSvc.lookupInstance(sample.ResourceMetadata["instance_id"]),
-				}
-			},
-		},
-		// Network
-		"network.services.firewall.policy": {
-			desc: prometheus.NewDesc(makeFQName("firewall_policy"), "Firewall policy", []string{"name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["name"],
-				}
-			},
-		},
-		"network.services.lb.vip": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool"), "Load balancer pool", []string{"name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["name"],
-				}
-			},
-		},
-		"network.services.lb.pool": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_vip"), "Load balancer virtual IP", []string{"name"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceMetadata["name"],
-				}
-			},
-		},
-		"network.services.lb.member": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool_member"), "Load balancer pool member", []string{"member", "status", "pool"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					fmt.Sprintf("%s:%s", sample.ResourceMetadata["address"], sample.ResourceMetadata["protocol_port"]),
-					sample.ResourceMetadata["status"],
-					lookupSvc.lookupPool(sample.ResourceMetadata["pool_id"]),
-				}
-			},
-		},
-		"network.services.lb.incoming.bytes": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool_bytes_in"), "Load balancer pool bytes-in", []string{"pool"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					lookupSvc.lookupPool(sample.ResourceId),
-				}
-			},
-		},
-		"network.services.lb.outgoing.bytes": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool_bytes_out"), "Load balancer pool bytes-out", []string{"pool"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					lookupSvc.lookupPool(sample.ResourceId),
-				}
-			},
-		},
-		"network.services.lb.active.connections": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool_active_connections"), "Load balancer pool active connections", []string{"pool"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					lookupSvc.lookupPool(sample.ResourceId),
-				}
-			},
-		},
-		"network.services.lb.total.connections": {
-			desc: prometheus.NewDesc(makeFQName("loadbalancer_pool_total_connections"), "Load balancer pool total connections", []string{"pool"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					lookupSvc.lookupPool(sample.ResourceId),
-				}
-			},
-		},
-		// Swift
-		"storage.containers.objects": {
-			desc: prometheus.NewDesc(makeFQName("swift_objects"), "Swift container objects", []string{"container_id"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					strings.SplitN(sample.ResourceId, "/", 2)[1],
-				}
-			},
-		},
-		"storage.containers.objects.size": {
-			desc: prometheus.NewDesc(makeFQName("swift_objects_size"), "Swift container size (bytes)", []string{"container_id"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					strings.SplitN(sample.ResourceId, "/", 2)[1],
-				}
-			},
-		},
-		// Usage
-		"instance": {
-			desc: prometheus.NewDesc(makeFQName("instance"), "Instances", []string{"instance_id", "instance_name", "flavor"}, nil),
-			extractLabels: func(sample *meters.OldSample) []string {
-				return []string{
-					sample.ResourceId,
-					sample.ResourceMetadata["display_name"],
-					sample.ResourceMetadata["flavor.name"],
+// MeterDefinition describes how samples of a Ceilometer meter are exported.
+type MeterDefinition struct {
+	// Metric is the name of the Prometheus metric, without the namespace prefix
+	Metric string `yaml:"metric"`
+	Help   string `yaml:"help"`
+	// Type overrides the value type given by the sample type. One of gauge, counter or untyped.
+	Type string `yaml:"type"`
+	// SampleType is the Ceilometer sample type of the meter, for backends whose samples have
+	// none, such as Gnocchi. One of gauge (the default), cumulative or delta.
+	SampleType string `yaml:"sample_type"`
+	// Scale multiplies the sample volume, for converting units
+	Scale  float64           `yaml:"scale"`
+	Labels []LabelDefinition `yaml:"labels"`
+	// Identity lists the labels that identify a series. Of the samples with the same values of
+	// these labels, only the newest is exported. By default, all labels are used.
+	Identity []string `yaml:"identity"`
+
+	// Mode is samples (the default), exporting the latest sample of each resource, or
+	// statistics, exporting aggregates over the query window as <metric>_<statistic>. In
+	// statistics mode, the samples are grouped by the GroupBy fields, and labels can only be
+	// taken from these.
+	Mode       string   `yaml:"mode"`
+	Statistics []string `yaml:"statistics"`
+	GroupBy    []string `yaml:"group_by"`
+}
+
+// LabelDefinition describes how the value of a label is taken from a sample. The value comes
+// from a sample field, given by From, or from a Template containing fields as {field}. Fields
+// are resource_id, project_id, user_id or metadata.<path>, where path is a dotted path into
+// nested metadata. If Regex is given, the value is replaced by its first submatch, and if
+// Lookup is given, the value is resolved as an id of that kind.
+type LabelDefinition struct {
+	Name     string `yaml:"name"`
+	From     string `yaml:"from"`
+	Template string `yaml:"template"`
+	Regex    string `yaml:"regex"`
+	Lookup   string `yaml:"lookup"`
+}
+
+type meterDefinitionsFile struct {
+	Meters map[string]MeterDefinition `yaml:"meters"`
+	// CommonLabels are added to all meters in samples mode that do not define a label of the
+	// same name themselves
+	CommonLabels []LabelDefinition `yaml:"common_labels"`
+}
+
+// Kinds of lookups available to labels, and the service each of them requires
+var lookupServiceTypes = map[string]string{
+	"instance": computeServiceType,
+	"pool":     networkServiceType,
+}
+
+var (
+	validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	validLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	templateField   = regexp.MustCompile(`\{([^{}]*)\}`)
+)
+
+const (
+	meterModeSamples    = "samples"
+	meterModeStatistics = "statistics"
+)
+
+var (
+	allStatistics     = []string{"avg", "min", "max", "sum", "count"}
+	defaultStatistics = allStatistics
+	defaultGroupBy    = []string{"resource_id"}
+)
+
+var valueTypes = map[string]prometheus.ValueType{
+	"gauge":   prometheus.GaugeValue,
+	"counter": prometheus.CounterValue,
+	"untyped": prometheus.UntypedValue,
+}
+
+var sampleTypes = map[string]bool{"gauge": true, "cumulative": true, "delta": true}
+
+// loadMeterDefinitions returns the built-in meter definitions, merged with those in filename
+// if given, and the common labels of both. Definitions in the file replace built-in ones for the
+// same meter, and its common labels are added to all meters, where they can be used in identity.
+// No two meters may be exported under the same name, nor under that of a metric of the exporter
+// itself.
+func loadMeterDefinitions(filename string) (map[string]MeterDefinition, []LabelDefinition, error) {
+	const builtinFilename = "built-in meter definitions"
+	builtin, err := parseMeterDefinitions(defaultMeterDefinitionsFile, builtinFilename)
+	if err != nil {
+		return nil, nil, err
+	}
+	definitions := builtin.Meters
+	commonLabels := builtin.CommonLabels
+	sources := make(map[string]string, len(definitions))
+	for name := range definitions {
+		sources[name] = builtinFilename
+	}
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		overrides, err := parseMeterDefinitions(content, filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, definition := range overrides.Meters {
+			definitions[name] = definition
+			sources[name] = filename
+		}
+		commonLabels = append(commonLabels, overrides.CommonLabels...)
+	}
+
+	for name, definition := range definitions {
+		if definition.Mode == meterModeStatistics {
+			continue
+		}
+		for _, label := range commonLabels {
+			if definition.labelIndex(label.Name) < 0 {
+				definition.Labels = append(definition.Labels, label)
+			}
+		}
+		definitions[name] = definition
+	}
+
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		definition := definitions[name]
+		for _, label := range definition.Identity {
+			if definition.labelIndex(label) < 0 {
+				return nil, nil, fmt.Errorf("%s: meter %q: identity: unknown label %q", sources[name], name, label)
+			}
+		}
+	}
+	if err := checkMetricNames(definitions, names); err != nil {
+		return nil, nil, err
+	}
+	return definitions, commonLabels, nil
+}
+
+// checkMetricNames verifies that the named meters are exported under distinct names, none of
+// them used by the exporter itself.
+func checkMetricNames(definitions map[string]MeterDefinition, names []string) error {
+	exportedBy := newMetricNameOwners()
+	for _, name := range names {
+		if err := exportedBy.check(name, definitions[name]); err != nil {
+			return err
+		}
+		exportedBy.add(name, definitions[name])
+	}
+	return nil
+}
+
+// metricNameOwners maps exported metric names to the meters exporting them, or to "" for the
+// metrics of the exporter itself.
+type metricNameOwners map[string]string
+
+func newMetricNameOwners() metricNameOwners {
+	owners := make(metricNameOwners)
+	for name := range metaMetricNames() {
+		owners[name] = ""
+	}
+	return owners
+}
+
+// check returns an error if a metric of the named meter is already exported.
+func (o metricNameOwners) check(name string, definition MeterDefinition) error {
+	for _, metric := range definition.metricNames() {
+		other, ok := o[makeFQName(metric)]
+		switch {
+		case ok && other == "":
+			return fmt.Errorf("meter %q would be exported as %q, which is a metric of the exporter itself", name, metric)
+		case ok:
+			return fmt.Errorf("meters %q and %q are both exported as %q", other, name, metric)
+		}
+	}
+	return nil
+}
+
+func (o metricNameOwners) add(name string, definition MeterDefinition) {
+	for _, metric := range definition.metricNames() {
+		o[makeFQName(metric)] = name
+	}
+}
+
+func parseMeterDefinitions(content []byte, filename string) (*meterDefinitionsFile, error) {
+	var file meterDefinitionsFile
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if file.Meters == nil {
+		file.Meters = make(map[string]MeterDefinition)
+	}
+	names := map[string]bool{"cloud": true, "region": true}
+	for _, label := range file.CommonLabels {
+		if !validLabelName.MatchString(label.Name) {
+			return nil, fmt.Errorf("%s: invalid common label name %q", filename, label.Name)
+		}
+		if names[label.Name] {
+			return nil, fmt.Errorf("%s: duplicate or reserved common label name %q", filename, label.Name)
+		}
+		names[label.Name] = true
+		if err := label.validate(); err != nil {
+			return nil, fmt.Errorf("%s: common label %q: %v", filename, label.Name, err)
+		}
+	}
+	for name, definition := range file.Meters {
+		if err := definition.validate(); err != nil {
+			return nil, fmt.Errorf("%s: meter %q: %v", filename, name, err)
+		}
+		if definition.Help == "" {
+			definition.Help = fmt.Sprintf("Ceilometer meter %s", name)
+			file.Meters[name] = definition
+		}
+	}
+	return &file, nil
+}
+
+func (d *MeterDefinition) validate() error {
+	if !validMetricName.MatchString(d.Metric) {
+		return fmt.Errorf("invalid metric name %q", d.Metric)
+	}
+	if _, ok := valueTypes[d.Type]; d.Type != "" && !ok {
+		return fmt.Errorf("invalid type %q, must be one of gauge, counter or untyped", d.Type)
+	}
+	if d.SampleType != "" && !sampleTypes[d.SampleType] {
+		return fmt.Errorf("invalid sample_type %q, must be one of gauge, cumulative or delta", d.SampleType)
+	}
+	switch d.Mode {
+	case "", meterModeSamples:
+		if len(d.Statistics) > 0 || len(d.GroupBy) > 0 {
+			return fmt.Errorf("statistics and group_by can only be used with mode statistics")
+		}
+	case meterModeStatistics:
+		if d.Type != "" || d.SampleType != "" {
+			return fmt.Errorf("type and sample_type cannot be used with mode statistics, all statistics are gauges")
+		}
+		if len(d.Identity) > 0 {
+			return fmt.Errorf("identity cannot be used with mode statistics, each group is a series")
+		}
+		for _, statistic := range d.Statistics {
+			if !contains(allStatistics, statistic) {
+				return fmt.Errorf("invalid statistic %q, must be one of %s", statistic, strings.Join(allStatistics, ", "))
+			}
+		}
+		for _, field := range d.GroupBy {
+			if _, ok := sampleField(&meters.OldSample{}, field); !ok {
+				return fmt.Errorf("cannot group by unknown field %q, must be one of resource_id, project_id, user_id or metadata.<key>", field)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid mode %q, must be samples or statistics", d.Mode)
+	}
+
+	names := map[string]bool{"cloud": true, "region": true}
+	for _, label := range d.Labels {
+		if !validLabelName.MatchString(label.Name) {
+			return fmt.Errorf("invalid label name %q", label.Name)
+		}
+		if names[label.Name] {
+			return fmt.Errorf("duplicate or reserved label name %q", label.Name)
+		}
+		names[label.Name] = true
+		if err := label.validate(); err != nil {
+			return fmt.Errorf("label %q: %v", label.Name, err)
+		}
+		if d.Mode == meterModeStatistics {
+			for _, field := range label.fields() {
+				if !contains(d.groupBy(), field) {
+					return fmt.Errorf("label %q: field %q is not grouped by", label.Name, field)
 				}
-			},
+			}
+		}
+	}
+	return nil
+}
+
+// metricNames returns the names the meter is exported as: the metric name, or in statistics
+// mode <metric>_<statistic> for each statistic.
+func (d *MeterDefinition) metricNames() []string {
+	if d.Mode != meterModeStatistics {
+		return []string{d.Metric}
+	}
+	var names []string
+	for _, statistic := range d.statistics() {
+		names = append(names, d.Metric+"_"+statistic)
+	}
+	return names
+}
+
+// labelIndex returns the position of the named label, or -1 if there is none.
+func (d *MeterDefinition) labelIndex(name string) int {
+	for i, label := range d.Labels {
+		if label.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *MeterDefinition) statistics() []string {
+	if len(d.Statistics) == 0 {
+		return defaultStatistics
+	}
+	return d.Statistics
+}
+
+func (d *MeterDefinition) groupBy() []string {
+	if len(d.GroupBy) == 0 {
+		return defaultGroupBy
+	}
+	return d.GroupBy
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *LabelDefinition) validate() error {
+	if (l.From == "") == (l.Template == "") {
+		return fmt.Errorf("exactly one of from and template must be set")
+	}
+	for _, field := range l.fields() {
+		if _, ok := sampleField(&meters.OldSample{}, field); !ok {
+			return fmt.Errorf("unknown field %q, must be one of resource_id, project_id, user_id or metadata.<key>", field)
+		}
+	}
+	if l.Regex != "" {
+		if _, err := regexp.Compile(l.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	if _, ok := lookupServiceTypes[l.Lookup]; l.Lookup != "" && !ok {
+		return fmt.Errorf("invalid lookup %q, must be instance or pool", l.Lookup)
+	}
+	return nil
+}
+
+// fields returns the sample fields used by the label.
+func (l *LabelDefinition) fields() []string {
+	if l.Template == "" {
+		return []string{l.From}
+	}
+	var fields []string
+	for _, match := range templateField.FindAllStringSubmatch(l.Template, -1) {
+		fields = append(fields, match[1])
+	}
+	return fields
+}
+
+// sampleField returns the value of a field of sample, as named in label definitions.
+func sampleField(sample *meters.OldSample, field string) (string, bool) {
+	switch field {
+	case "resource_id":
+		return sample.ResourceId, true
+	case "project_id":
+		return sample.ProjectId, true
+	case "user_id":
+		return sample.UserId, true
+	}
+	if strings.HasPrefix(field, "metadata.") {
+		return metadataValue(sample.ResourceMetadata, strings.TrimPrefix(field, "metadata.")), true
+	}
+	return "", false
+}
+
+// metadataValue returns the value at a dotted path in the metadata, or an empty string if
+// there is none. Ceilometer may return nested metadata either as is or flattened to dotted
+// keys, so at each level the longest key matching the start of the path is used. Values that
+// are not strings are formatted as JSON.
+func metadataValue(metadata map[string]interface{}, path string) string {
+	for end := len(path); end > 0; end = strings.LastIndexByte(path[:end], '.') {
+		value, ok := metadata[path[:end]]
+		if !ok {
+			continue
+		}
+		if end == len(path) {
+			return formatMetadataValue(value)
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			if found := metadataValue(nested, path[end+1:]); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func formatMetadataValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// statisticsQueryField translates a field name to the one used by the statistics API.
+func statisticsQueryField(field string) string {
+	if strings.HasPrefix(field, "metadata.") {
+		return "resource_" + field
+	}
+	return field
+}
+
+// groupToSample creates a sample holding the fields of a statistics group, so that labels can
+// be extracted from it as from a sample.
+func groupToSample(groupBy map[string]string) *meters.OldSample {
+	sample := &meters.OldSample{
+		ResourceId:       groupBy["resource_id"],
+		ProjectId:        groupBy["project_id"],
+		UserId:           groupBy["user_id"],
+		ResourceMetadata: make(map[string]interface{}),
+	}
+	for field, value := range groupBy {
+		if strings.HasPrefix(field, "resource_metadata.") {
+			sample.ResourceMetadata[strings.TrimPrefix(field, "resource_metadata.")] = value
+		}
+	}
+	return sample
+}
+
+// extractor returns a function computing the label value from a sample. Names are looked up
+// within the deadline of ctx.
+func (l LabelDefinition) extractor(lookupSvc *LookupService) func(context.Context, *meters.OldSample) string {
+	var regex *regexp.Regexp
+	if l.Regex != "" {
+		regex = regexp.MustCompile(l.Regex)
+	}
+
+	return func(ctx context.Context, sample *meters.OldSample) string {
+		var value string
+		if l.Template != "" {
+			value = templateField.ReplaceAllStringFunc(l.Template, func(field string) string {
+				fieldValue, _ := sampleField(sample, field[1:len(field)-1])
+				return fieldValue
+			})
+		} else {
+			value, _ = sampleField(sample, l.From)
+		}
+
+		if regex != nil {
+			if match := regex.FindStringSubmatch(value); len(match) > 1 {
+				value = match[1]
+			} else if len(match) == 1 {
+				value = match[0]
+			}
+		}
+
+		switch l.Lookup {
+		case "instance":
+			value = lookupSvc.lookupInstance(ctx, value)
+		case "pool":
+			value = lookupSvc.lookupPool(ctx, value)
+		}
+		return value
+	}
+}
+
+// build creates the collector metric for the definition. The lookup service is only used when
+// extracting labels, so it may be nil if no samples are to be handled.
+func (d MeterDefinition) build(lookupSvc *LookupService, constLabels prometheus.Labels) ceilometerMetric {
+	labelNames := make([]string, len(d.Labels))
+	extractors := make([]func(context.Context, *meters.OldSample) string, len(d.Labels))
+	var requires []string
+	for i, label := range d.Labels {
+		labelNames[i] = label.Name
+		extractors[i] = label.extractor(lookupSvc)
+		if label.Lookup != "" {
+			requires = append(requires, lookupServiceTypes[label.Lookup])
+		}
+	}
+
+	metric := ceilometerMetric{
+		extractLabels: func(ctx context.Context, sample *meters.OldSample) []string {
+			values := make([]string, len(extractors))
+			for i, extract := range extractors {
+				values[i] = extract(ctx, sample)
+			}
+			return values
 		},
+		backend:    ceilometerBackend{},
+		requires:   requires,
+		scale:      d.Scale,
+		sampleType: d.SampleType,
+	}
+	for _, name := range d.Identity {
+		metric.identity = append(metric.identity, d.labelIndex(name))
+	}
+	if metric.scale == 0 {
+		metric.scale = 1
+	}
+	if valueType, ok := valueTypes[d.Type]; ok {
+		metric.valueType = &valueType
+	}
+	if d.Mode != meterModeStatistics {
+		metric.desc = prometheus.NewDesc(makeFQName(d.Metric), d.Help, labelNames, constLabels)
+	} else {
+		metric.statistics = make(map[string]*prometheus.Desc)
+		for _, statistic := range d.statistics() {
+			help := fmt.Sprintf("%s (%s over the query window)", d.Help, statistic)
+			metric.statistics[statistic] = prometheus.NewDesc(makeFQName(d.Metric+"_"+statistic), help, labelNames, constLabels)
+		}
+		for _, field := range d.groupBy() {
+			metric.groupBy = append(metric.groupBy, statisticsQueryField(field))
+		}
+	}
+	return metric
+}
+
+func getMetrics(definitions map[string]MeterDefinition, lookupSvc *LookupService, constLabels prometheus.Labels) *map[string]ceilometerMetric {
+	metrics := make(map[string]ceilometerMetric, len(definitions))
+	for name, definition := range definitions {
+		metrics[name] = definition.build(lookupSvc, constLabels)
 	}
+	return &metrics
 }
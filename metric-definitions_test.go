@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+)
+
+func TestMetadataValue(t *testing.T) {
+	metadata := map[string]interface{}{
+		"display_name": "vm1",
+		"flavor.name":  "m1.small",
+		"flavor": map[string]interface{}{
+			"name":  "ignored",
+			"vcpus": float64(2),
+			"ram":   float64(2048),
+		},
+		"user_metadata": map[string]interface{}{
+			"team": "storage",
+		},
+		"metadata": map[string]interface{}{
+			"metering.team": "compute",
+		},
+		"tags":    []interface{}{"a", "b"},
+		"enabled": true,
+		"empty":   nil,
+	}
+
+	for path, expected := range map[string]string{
+		"display_name":           "vm1",
+		"flavor.name":            "m1.small",
+		"flavor.vcpus":           "2",
+		"flavor.ram":             "2048",
+		"user_metadata.team":     "storage",
+		"metadata.metering.team": "compute",
+		"tags":                   `["a","b"]`,
+		"enabled":                "true",
+		"empty":                  "",
+		"missing":                "",
+		"flavor.missing":         "",
+		"display_name.nested":    "",
+	} {
+		if value := metadataValue(metadata, path); value != expected {
+			t.Errorf("expected %q at %s, got %q", expected, path, value)
+		}
+	}
+}
+
+func TestCommonLabels(t *testing.T) {
+	file, err := ioutil.TempFile("", "meters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+common_labels:
+  - name: team
+    from: metadata.user_metadata.team
+  - name: instance_id
+    from: metadata.instance_id
+`)
+	file.Close()
+
+	definitions, commonLabels, err := loadMeterDefinitions(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commonLabels) == 0 || commonLabels[len(commonLabels)-1].Name != "instance_id" {
+		t.Errorf("expected the common labels of the file to be returned, got %v", commonLabels)
+	}
+
+	cpu := definitions["cpu"]
+	if cpu.labelIndex("team") < 0 {
+		t.Errorf("expected common label to be added to cpu, got %v", cpu.Labels)
+	}
+	if index := cpu.labelIndex("instance_id"); index < 0 || cpu.Labels[index].From != "resource_id" {
+		t.Errorf("expected the label defined by cpu to take precedence, got %v", cpu.Labels)
+	}
+	for name, definition := range definitions {
+		if definition.Mode == meterModeStatistics && definition.labelIndex("team") >= 0 {
+			t.Errorf("expected no common labels on %s, which is in statistics mode", name)
+		}
+	}
+
+	metric := cpu.build(nil, nil)
+	labels := metric.extractLabels(context.Background(), &meters.OldSample{
+		ResourceId: "i1",
+		ResourceMetadata: map[string]interface{}{
+			"user_metadata": map[string]interface{}{"team": "storage"},
+		},
+	})
+	if labels[cpu.labelIndex("team")] != "storage" {
+		t.Errorf("expected team label storage, got %v", labels)
+	}
+}
+
+func TestLoadMeterDefinitionsErrors(t *testing.T) {
+	for _, test := range []struct {
+		content, err string
+	}{
+		{`
+meters:
+  custom:
+    metric: cpu_nanoseconds
+`, `meters "cpu" and "custom" are both exported as "cpu_nanoseconds"`},
+		{`
+meters:
+  custom.rate:
+    metric: custom
+    mode: statistics
+  custom.max:
+    metric: custom_max
+`, `meters "custom.max" and "custom.rate" are both exported as "custom_max"`},
+		{`
+meters:
+  custom:
+    metric: up
+`, `meter "custom" would be exported as "up", which is a metric of the exporter itself`},
+		{`
+meters:
+  custom:
+    metric: custom
+    labels:
+      - name: resource_id
+        from: resource_id
+    identity: [team]
+`, `meter "custom": identity: unknown label "team"`},
+	} {
+		file, err := ioutil.TempFile("", "meters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(test.content)
+		file.Close()
+
+		_, _, err = loadMeterDefinitions(file.Name())
+		os.Remove(file.Name())
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestIdentityOfCommonLabels(t *testing.T) {
+	file, err := ioutil.TempFile("", "meters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`
+common_labels:
+  - name: team
+    from: metadata.user_metadata.team
+meters:
+  custom:
+    metric: custom
+    labels:
+      - name: resource_id
+        from: resource_id
+    identity: [team]
+`)
+	file.Close()
+
+	definitions, _, err := loadMeterDefinitions(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric := definitions["custom"].build(nil, nil); len(metric.identity) != 1 || metric.identity[0] != 1 {
+		t.Errorf("expected the series to be identified by the common label, got %v", metric.identity)
+	}
+}
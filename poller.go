@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// meterPoller scrapes meters of a cloud in the background, each on its own interval, and keeps
+// the results of the latest poll for the collectors to serve. This decouples the requests made
+// to Ceilometer from the number of Prometheus servers scraping the exporter.
+type meterPoller struct {
+	cloud  *openstackCloud
+	jitter time.Duration
+
+	mu      sync.RWMutex
+	results map[string]*pollResult
+}
+
+// pollResult holds the outcome of the latest poll of a meter. If it failed, the metrics of the
+// last successful poll are kept.
+type pollResult struct {
+	metrics []prometheus.Metric
+	stats   scrapeStats
+	// updated is the time of the poll producing metrics, zero if none has succeeded yet
+	updated time.Time
+	// timestamps tracks the exported sample times of the polled meter
+	timestamps *seriesTimestamps
+}
+
+// startPolling starts polling the meters with a poll interval that are chosen by any of the
+// selections, which must cover every collector of the cloud.
+func (c *openstackCloud) startPolling(selections []MetricSelection) {
+	polled := make(map[string]ceilometerMetric)
+	for _, selection := range selections {
+		for name, metric := range c.metrics(selection) {
+			if metric.settings.PollInterval > 0 {
+				polled[name] = metric
+			}
+		}
+	}
+	if len(polled) == 0 {
+		return
+	}
+
+	c.poller = &meterPoller{
+		cloud:   c,
+		jitter:  c.config.PollJitter,
+		results: make(map[string]*pollResult),
+	}
+	log.Infof("Polling %d meters of cloud %s in the background", len(polled), c.config.Name)
+	for name, metric := range polled {
+		go c.poller.pollLoop(name, metric)
+	}
+}
+
+// pollLoop polls a meter once per poll interval, starting each poll at a random offset of up
+// to the jitter into its period. A poll is cancelled at the end of its period, so that the
+// results are renewed at least every poll interval plus jitter.
+func (p *meterPoller) pollLoop(resourceLabel string, metric ceilometerMetric) {
+	interval := metric.settings.PollInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	period := time.Now()
+	for {
+		if jitter := p.jitter; jitter > 0 {
+			if jitter > interval {
+				jitter = interval
+			}
+			time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		p.poll(resourceLabel, metric, period.Add(interval))
+		period = <-ticker.C
+	}
+}
+
+// poll scrapes a meter, stopping at deadline, and stores the result.
+func (p *meterPoller) poll(resourceLabel string, metric ceilometerMetric, deadline time.Time) {
+	// The cloud is not locked during the scrape, so that it can reconnect meanwhile
+	cloud := p.cloud
+	cloud.mu.RLock()
+	connected, client := cloud.connected, cloud.client
+	cloud.mu.RUnlock()
+	if !connected {
+		return
+	}
+	if serviceType, ok := cloud.lookupSvc.missing(metric.requires); ok {
+		log.Debugf("Not polling %s, as %s lookups are disabled", resourceLabel, serviceType)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	start := time.Now()
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	var metrics []prometheus.Metric
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	result := make(chan scrapeStats, 1)
+	scrape(ctx, resourceLabel, metric, client, ch, result)
+	close(ch)
+	<-done
+
+	// The results are as old as the queries, rather than the end of the poll
+	p.store(resourceLabel, metrics, <-result, metric.timestamps, start)
+}
+
+func (p *meterPoller) store(resourceLabel string, metrics []prometheus.Metric, stats scrapeStats, timestamps *seriesTimestamps, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	polled := &pollResult{stats: stats, timestamps: timestamps}
+	if stats.success {
+		polled.metrics = metrics
+		polled.updated = now
+	} else if previous, ok := p.results[resourceLabel]; ok {
+		polled.metrics = previous.metrics
+		polled.updated = previous.updated
+		polled.stats.oldestSample = previous.stats.oldestSample
+		polled.stats.newestSample = previous.stats.newestSample
+	}
+	p.results[resourceLabel] = polled
+}
+
+// result returns the latest poll of a meter, if it has been polled.
+func (p *meterPoller) result(resourceLabel string) (*pollResult, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	polled, ok := p.results[resourceLabel]
+	return polled, ok
+}
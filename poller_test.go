@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPollerServesLastSuccessfulPoll(t *testing.T) {
+	cloud := &openstackCloud{config: defaultConfig()}
+	cloud.config.definitions = map[string]MeterDefinition{"cpu": {Metric: "cpu"}}
+	cloud.poller = &meterPoller{cloud: cloud, results: make(map[string]*pollResult)}
+	collector := NewCeilometerCollector(cloud, cloud.config.MetricSelection)
+	metric := collector.metrics["cpu"]
+	metric.settings.PollInterval = time.Minute
+
+	polledAt := time.Now()
+	value := prometheus.MustNewConstMetric(metric.desc, prometheus.GaugeValue, 1)
+	cloud.poller.store("cpu", []prometheus.Metric{value}, scrapeStats{resourceLabel: "cpu", success: true}, nil, polledAt)
+	cloud.poller.store("cpu", nil, scrapeStats{resourceLabel: "cpu"}, nil, polledAt.Add(time.Minute))
+
+	collect := func(t time.Time) (int, bool) {
+		ch := make(chan prometheus.Metric, 20)
+		collector.sendPolled(ch, "cpu", metric, t)
+		close(ch)
+		values, hasAge := 0, false
+		for m := range ch {
+			switch m.Desc() {
+			case metric.desc:
+				values++
+			case collector.metaMetrics["pollAge"]:
+				hasAge = true
+			}
+		}
+		return values, hasAge
+	}
+
+	if values, hasAge := collect(polledAt.Add(2 * time.Minute)); values != 1 || !hasAge {
+		t.Errorf("expected the metrics of the successful poll to be served after a failed one, got %d metrics", values)
+	}
+	if values, hasAge := collect(polledAt.Add(metric.settings.MaxMetricAge + time.Second)); values != 0 || !hasAge {
+		t.Errorf("expected metrics older than max_metric_age to be dropped, got %d metrics", values)
+	}
+	if _, ok := cloud.poller.result("memory"); ok {
+		t.Errorf("expected no result for a meter that has not been polled")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// contextCollector is implemented by the collectors that stop scraping when the context of the
+// request being served is done. The registry calls CollectWithContext instead of Collect for them.
+type contextCollector interface {
+	prometheus.Collector
+	CollectWithContext(context.Context, chan<- prometheus.Metric)
+}
+
+// metricRegistry serves the metrics of a set of collectors. Unlike the global registry of the
+// prometheus package, any number of them can be created, such as one for each probe, and the
+// collectors are given the context of the request.
+type metricRegistry struct {
+	collectors []prometheus.Collector
+	descs      map[string]bool
+}
+
+func newMetricRegistry() *metricRegistry {
+	return &metricRegistry{descs: make(map[string]bool)}
+}
+
+// Register adds a collector, which must describe at least one metric, none of them already
+// described by another collector.
+func (r *metricRegistry) Register(collector prometheus.Collector) error {
+	var descs []string
+	for _, desc := range describe(collector) {
+		descs = append(descs, desc.String())
+	}
+	if len(descs) == 0 {
+		return fmt.Errorf("collector has no descriptors")
+	}
+	for _, desc := range descs {
+		if r.descs[desc] {
+			return fmt.Errorf("descriptor %s already registered", desc)
+		}
+	}
+	for _, desc := range descs {
+		r.descs[desc] = true
+	}
+	r.collectors = append(r.collectors, collector)
+	return nil
+}
+
+// ServeHTTP collects the metrics, stopping the context collectors when the request is done, and
+// writes them in the format negotiated with the client.
+func (r *metricRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	families, err := r.gather(req.Context())
+	if err != nil {
+		http.Error(w, "An error has occurred:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contentType := expfmt.Negotiate(req.Header)
+	w.Header().Set("Content-Type", string(contentType))
+	encoder := expfmt.NewEncoder(w, contentType)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			log.Warnf("Failed to write metrics: %v", err)
+			return
+		}
+	}
+}
+
+// gather collects from all collectors at once, and groups the metrics into families sorted by
+// name.
+func (r *metricRegistry) gather(ctx context.Context) ([]*dto.MetricFamily, error) {
+	metricChan := make(chan prometheus.Metric, 1024)
+	var wg sync.WaitGroup
+	wg.Add(len(r.collectors))
+	for _, collector := range r.collectors {
+		go func(collector prometheus.Collector) {
+			defer wg.Done()
+			if contextCollector, ok := collector.(contextCollector); ok {
+				contextCollector.CollectWithContext(ctx, metricChan)
+			} else {
+				collector.Collect(metricChan)
+			}
+		}(collector)
+	}
+	go func() {
+		wg.Wait()
+		close(metricChan)
+	}()
+	// Collectors are left to finish if a metric fails
+	defer func() {
+		for range metricChan {
+		}
+	}()
+
+	familiesByName := make(map[string]*dto.MetricFamily)
+	for metric := range metricChan {
+		name, help, err := descNameAndHelp(metric.Desc())
+		if err != nil {
+			return nil, err
+		}
+		out := &dto.Metric{}
+		if err := metric.Write(out); err != nil {
+			return nil, fmt.Errorf("error collecting metric %v: %v", metric.Desc(), err)
+		}
+		family, ok := familiesByName[name]
+		if !ok {
+			family = &dto.MetricFamily{Name: proto.String(name), Help: proto.String(help)}
+			familiesByName[name] = family
+		}
+		metricType, err := dtoMetricType(out)
+		if err != nil {
+			return nil, fmt.Errorf("error collecting metric %v: %v", metric.Desc(), err)
+		}
+		if family.Type == nil {
+			family.Type = metricType.Enum()
+		} else if *family.Type != metricType {
+			return nil, fmt.Errorf("metric %s collected as both %s and %s", name, family.Type, metricType)
+		}
+		family.Metric = append(family.Metric, out)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(familiesByName))
+	for _, family := range familiesByName {
+		sort.Slice(family.Metric, func(i, j int) bool {
+			return labelsLess(family.Metric[i].Label, family.Metric[j].Label)
+		})
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families, nil
+}
+
+// describe returns the descriptors of the metrics of collector.
+func describe(collector prometheus.Collector) []*prometheus.Desc {
+	descChan := make(chan *prometheus.Desc)
+	go func() {
+		collector.Describe(descChan)
+		close(descChan)
+	}()
+	var descs []*prometheus.Desc
+	for desc := range descChan {
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// descNameAndHelp returns the name and help of a metric, which the prometheus package only
+// exposes through the string form of its descriptor.
+func descNameAndHelp(desc *prometheus.Desc) (string, string, error) {
+	var name, help string
+	if _, err := fmt.Sscanf(desc.String(), "Desc{fqName: %q, help: %q", &name, &help); err != nil {
+		return "", "", fmt.Errorf("unreadable descriptor %s: %v", desc, err)
+	}
+	return name, help, nil
+}
+
+func dtoMetricType(metric *dto.Metric) (dto.MetricType, error) {
+	switch {
+	case metric.Gauge != nil:
+		return dto.MetricType_GAUGE, nil
+	case metric.Counter != nil:
+		return dto.MetricType_COUNTER, nil
+	case metric.Summary != nil:
+		return dto.MetricType_SUMMARY, nil
+	case metric.Untyped != nil:
+		return dto.MetricType_UNTYPED, nil
+	case metric.Histogram != nil:
+		return dto.MetricType_HISTOGRAM, nil
+	}
+	return 0, fmt.Errorf("empty metric collected: %s", metric)
+}
+
+// labelsLess orders metrics by their label values. The labels of a metric are sorted by name.
+func labelsLess(a, b []*dto.LabelPair) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].GetName() != b[i].GetName() {
+			return a[i].GetName() < b[i].GetName()
+		}
+		if a[i].GetValue() != b[i].GetValue() {
+			return a[i].GetValue() < b[i].GetValue()
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testCollector exports a fixed set of values, and records the context it is collected with.
+type testCollector struct {
+	desc   *prometheus.Desc
+	values map[string]float64
+	ctx    context.Context
+}
+
+func (c *testCollector) Describe(ch chan<- *prometheus.Desc) {
+	if c.desc != nil {
+		ch <- c.desc
+	}
+}
+
+func (c *testCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *testCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	c.ctx = ctx
+	for label, value := range c.values {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, value, label)
+	}
+}
+
+func TestMetricRegistry(t *testing.T) {
+	registry := newMetricRegistry()
+	first := &testCollector{
+		desc:   prometheus.NewDesc("first", `Help with "quotes" and \ backslashes`, []string{"id"}, prometheus.Labels{"cloud": "a"}),
+		values: map[string]float64{"b": 2, "a": 1},
+	}
+	second := &testCollector{
+		desc:   prometheus.NewDesc("second", "Second", []string{"id"}, nil),
+		values: map[string]float64{"c": 3},
+	}
+	// Collectors that do not take a context are collected as well
+	third := prometheus.NewGauge(prometheus.GaugeOpts{Name: "third", Help: "Third"})
+	third.Set(4)
+	for _, collector := range []prometheus.Collector{second, first, third} {
+		if err := registry.Register(collector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.Register(&testCollector{desc: first.desc}); err == nil {
+		t.Errorf("expected a collector of the same metric to be rejected")
+	}
+	if err := registry.Register(&testCollector{}); err == nil {
+		t.Errorf("expected a collector without descriptors to be rejected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/probe", nil).WithContext(ctx))
+	expected := `# HELP first Help with "quotes" and \\ backslashes
+# TYPE first gauge
+first{cloud="a",id="a"} 1
+first{cloud="a",id="b"} 2
+# HELP second Second
+# TYPE second gauge
+second{id="c"} 3
+# HELP third Third
+# TYPE third gauge
+third 4
+`
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected the text format, got %s", recorder.Header().Get("Content-Type"))
+	}
+	if first.ctx != ctx || second.ctx != ctx {
+		t.Errorf("expected the collectors to be given the context of the request")
+	}
+}
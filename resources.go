@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DSpeichert/gophercloud/openstack/telemetry/v2/meters"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rackspace/gophercloud"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// resourcesMetric is the name under which the resources are enabled or disabled, like a meter.
+const resourcesMetric = "resources"
+
+type resource struct {
+	ResourceID string                 `json:"resource_id"`
+	ProjectID  string                 `json:"project_id"`
+	UserID     string                 `json:"user_id"`
+	Source     string                 `json:"source"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	// Links point to the resource itself and to each meter it has samples of, with the meter
+	// name as rel
+	Links []struct {
+		Href string `json:"href"`
+		Rel  string `json:"rel"`
+	} `json:"links"`
+}
+
+// listResources returns up to limit of the resources with samples from start to end, both
+// included, in no particular order.
+func listResources(client *gophercloud.ServiceClient, start, end time.Time, limit int) ([]resource, error) {
+	query := url.Values{
+		"q.field":     {"timestamp", "timestamp"},
+		"q.op":        {"ge", "le"},
+		"q.value":     {start.UTC().Format(timestampFormat), end.UTC().Format(timestampFormat)},
+		"meter_links": {"1"},
+		"limit":       {strconv.Itoa(limit)},
+	}
+	var resources []resource
+	// The JSON decoder fills in the value response points to
+	var response interface{} = &resources
+	_, err := client.Get(client.ServiceURL("v2", "resources")+"?"+query.Encode(), &response, nil)
+	return resources, err
+}
+
+// resourceType returns the first of types that the resource has samples of, or an empty string
+// if it has none of them.
+func resourceType(resource *resource, types []string) string {
+	for _, meterName := range types {
+		for _, link := range resource.Links {
+			if link.Rel == meterName {
+				return meterName
+			}
+		}
+	}
+	return ""
+}
+
+// resourceCollector exports the inventory of resources of a cloud, which have had samples within
+// max_metric_age. Meter series can be joined with the info series on resource_id to add the
+// owners and other labels of their resources.
+type resourceCollector struct {
+	cloud       *openstackCloud
+	info        *prometheus.Desc
+	count       *prometheus.Desc
+	metaMetrics map[string]*prometheus.Desc
+}
+
+// NewResourceCollector creates a collector for the resources of cloud. It is registered alongside
+// the ceilometerCollector of the cloud if resources are enabled by its metric selection.
+func NewResourceCollector(cloud *openstackCloud) *resourceCollector {
+	constLabels := cloud.constLabels()
+	infoLabels := []string{"resource_id", "project_id", "user_id", "source", "type"}
+	for _, label := range cloud.config.Resources.Labels {
+		infoLabels = append(infoLabels, label.Name)
+	}
+	return &resourceCollector{
+		cloud: cloud,
+		info:  prometheus.NewDesc(makeFQName("resource_info"), "Information about a resource with recent samples, always 1", infoLabels, constLabels),
+		count: prometheus.NewDesc(makeFQName("resources"), "Number of resources with recent samples by project and type", []string{"project_id", "type"}, constLabels),
+		metaMetrics: map[string]*prometheus.Desc{
+			"scrapeSuccess":  prometheus.NewDesc(makeFQName("resource_scrape_success"), "Indicates if the resources were successfully scraped", nil, constLabels),
+			"scrapeDuration": prometheus.NewDesc(makeFQName("resource_scrape_duration_ns"), "The time taken to scrape the resources", nil, constLabels),
+		},
+	}
+}
+
+func (c *resourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.count
+	for _, desc := range c.metaMetrics {
+		ch <- desc
+	}
+}
+
+func (c *resourceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+// CollectWithContext lists the resources, stopping the request when ctx is done. Gnocchi has no
+// resources API compatible with Ceilometer, so nothing is exported with that backend.
+func (c *resourceCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	t := time.Now()
+
+	cloud := c.cloud
+	cloud.mu.RLock()
+	connected, client := cloud.connected, cloud.client
+	cloud.mu.RUnlock()
+	if !connected || cloud.config.Backend != backendCeilometer {
+		return
+	}
+
+	// The API cannot page through the resources, which are listed by the time of their samples
+	// instead. Resources with samples at different times are listed more than once.
+	client = withContext(ctx, client)
+	limit := cloud.config.MaxResults
+	var resources []resource
+	end := t.UTC().Truncate(time.Microsecond)
+	complete, err := listTimeWindow(end.Add(-cloud.config.MaxMetricAge), end, limit, func(start, end time.Time) (int, error) {
+		page, err := listResources(client, start, end, limit)
+		resources = append(resources, page...)
+		return len(page), err
+	})
+	if err != nil {
+		log.Warnf("Failed to list resources of cloud %s: %v", cloud.config.Name, err)
+		resources = nil
+	} else if !complete {
+		log.Warnf("More than %d resources of cloud %s have samples at the same time, some of them are not listed", limit, cloud.config.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeSuccess"], prometheus.GaugeValue, btof(err == nil))
+	ch <- prometheus.MustNewConstMetric(c.metaMetrics["scrapeDuration"], prometheus.GaugeValue, float64(time.Since(t).Nanoseconds()))
+
+	var extractors []func(context.Context, *meters.OldSample) string
+	for _, label := range cloud.config.Resources.Labels {
+		extractors = append(extractors, label.extractor(&cloud.lookupSvc))
+	}
+	type projectType struct{ project, kind string }
+	counts := make(map[projectType]float64)
+	seen := make(map[string]bool)
+	for i := range resources {
+		resource := &resources[i]
+		if seen[resource.ResourceID] {
+			continue
+		}
+		seen[resource.ResourceID] = true
+
+		kind := resourceType(resource, cloud.config.Resources.Types)
+		counts[projectType{resource.ProjectID, kind}]++
+
+		// Labels are extracted as from a sample of the resource
+		sample := &meters.OldSample{
+			ResourceId:       resource.ResourceID,
+			ProjectId:        resource.ProjectID,
+			UserId:           resource.UserID,
+			Source:           resource.Source,
+			ResourceMetadata: resource.Metadata,
+		}
+		labels := []string{resource.ResourceID, resource.ProjectID, resource.UserID, resource.Source, kind}
+		for _, extract := range extractors {
+			labels = append(labels, extract(ctx, sample))
+		}
+		ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, labels...)
+	}
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.count, prometheus.GaugeValue, count, key.project, key.kind)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rackspace/gophercloud"
+)
+
+func TestResourceCollector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/resources" || r.URL.Query().Get("q.field") != "timestamp" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(`[
+			{"resource_id": "i1", "project_id": "p1", "user_id": "u1", "source": "openstack", "metadata": {"display_name": "vm1", "flavor": {"name": "m1.small"}},
+			 "links": [{"rel": "self"}, {"rel": "cpu"}, {"rel": "instance"}]},
+			{"resource_id": "i2", "project_id": "p1", "user_id": "u1", "source": "openstack", "metadata": {"display_name": "vm2"},
+			 "links": [{"rel": "self"}, {"rel": "instance"}]},
+			{"resource_id": "v1", "project_id": "p2", "user_id": "u2", "source": "openstack", "metadata": {},
+			 "links": [{"rel": "self"}, {"rel": "volume.size"}, {"rel": "volume"}]},
+			{"resource_id": "x1", "project_id": "p2", "source": "custom", "metadata": {},
+			 "links": [{"rel": "self"}, {"rel": "custom.meter"}]}
+		]`))
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.Resources.Labels = []LabelDefinition{
+		{Name: "name", From: "metadata.display_name"},
+		{Name: "flavor", From: "metadata.flavor.name"},
+	}
+	cloud := &openstackCloud{
+		config:    config,
+		connected: true,
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	collector := NewResourceCollector(cloud)
+	ch := make(chan prometheus.Metric, 20)
+	collector.Collect(ch)
+	close(ch)
+
+	info := make(map[string]map[string]string)
+	counts := make(map[string]float64)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		labels := make(map[string]string)
+		for _, label := range out.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		switch m.Desc() {
+		case collector.info:
+			info[labels["resource_id"]] = labels
+		case collector.count:
+			counts[labels["project_id"]+"/"+labels["type"]] = out.GetGauge().GetValue()
+		case collector.metaMetrics["scrapeSuccess"]:
+			if out.GetGauge().GetValue() != 1 {
+				t.Errorf("expected the scrape to succeed")
+			}
+		}
+	}
+
+	if labels := info["i1"]; labels["type"] != "instance" || labels["name"] != "vm1" || labels["flavor"] != "m1.small" || labels["user_id"] != "u1" || labels["source"] != "openstack" {
+		t.Errorf("unexpected labels of i1: %v", labels)
+	}
+	if labels := info["x1"]; labels["type"] != "" || labels["source"] != "custom" {
+		t.Errorf("unexpected labels of x1: %v", labels)
+	}
+	expected := map[string]float64{"p1/instance": 2, "p2/volume": 1, "p2/": 1}
+	if len(counts) != len(expected) {
+		t.Errorf("expected counts %v, got %v", expected, counts)
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("expected counts %v, got %v", expected, counts)
+		}
+	}
+}
+
+func TestResourceCollectorSplitsWindow(t *testing.T) {
+	// The resources have samples a minute apart, the newest a second ago
+	now := time.Now().UTC().Add(-time.Second)
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		values := query["q.value"]
+		if fmt.Sprint(query["q.op"]) != "[ge le]" || len(values) != 2 {
+			t.Fatalf("unexpected query %q", r.URL.RawQuery)
+		}
+		start, _ := time.Parse(timestampFormat, values[0])
+		end, _ := time.Parse(timestampFormat, values[1])
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page := []map[string]interface{}{}
+		for i := 0; i < 10 && len(page) < limit; i++ {
+			sampled := now.Add(-time.Duration(i) * time.Minute)
+			if !sampled.Before(start) && !sampled.After(end) {
+				page = append(page, map[string]interface{}{"resource_id": fmt.Sprintf("r%d", i), "project_id": "p1"})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	config := defaultConfig()
+	config.MaxResults = 3
+	config.MaxMetricAge = 10 * time.Minute
+	cloud := &openstackCloud{
+		config:    config,
+		connected: true,
+		client:    &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: server.URL + "/"},
+	}
+	collector := NewResourceCollector(cloud)
+	ch := make(chan prometheus.Metric, 20)
+	collector.Collect(ch)
+	close(ch)
+
+	for m := range ch {
+		if m.Desc() != collector.count {
+			continue
+		}
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		if count := out.GetGauge().GetValue(); count != 10 {
+			t.Errorf("expected all 10 resources to be listed, got %v", count)
+		}
+	}
+	if requests < 4 {
+		t.Errorf("expected the window to be split, got %d requests", requests)
+	}
+}